@@ -1,18 +1,29 @@
 package main
 
 import (
+	"build-http-protocol/internal/accesslog"
+	"build-http-protocol/internal/auth"
 	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/metrics"
+	"build-http-protocol/internal/ratelimit"
 	"build-http-protocol/internal/request"
 	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/secure"
 	"build-http-protocol/internal/server"
+	"build-http-protocol/internal/sse"
+	"build-http-protocol/internal/tracing"
+	"build-http-protocol/internal/websocket"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func request400() []byte {
@@ -36,49 +47,135 @@ func newHandlerError(statusCode response.StatusCode, message string) *server.Han
 	}
 }
 
-func toString(b []byte) string {
-	out := ""
-	for _, r := range b {
-		out += fmt.Sprintf("%02x", r)
+// route labels requests for metrics with the handler's own routes, so
+// clients can't add series by making up paths.
+func route(req *request.Request) string {
+	// the path, so query strings don't turn known routes into "other"
+	path := req.Path()
+	switch path {
+	case "/", "/metrics", "/yourproblem", "/myproblem", "/video", "/events", "/ws":
+		return path
 	}
-	return out
+	if strings.HasPrefix(path, "/httpbin/") {
+		return "/httpbin/"
+	}
+	return metrics.OTHER_ROUTE
 }
 
 func main() {
-	s, err := server.Serve(port, func(w *response.Writer, req *request.Request) *server.HandlerError {
+	registry := metrics.NewRegistry()
+	httpMetrics := metrics.NewHTTPMetrics(registry)
+	metricsHandler := metrics.Handler(registry)
+	if path := os.Getenv("HTPASSWD_FILE"); path != "" {
+		users, err := auth.LoadHtpasswd(path)
+		if err != nil {
+			log.Fatalf("Error loading %s: %v", path, err)
+		}
+		metricsHandler = auth.BasicMiddleware(auth.BasicOptions{Realm: "metrics", Verify: users.Verify})(metricsHandler)
+	}
+
+	// spans are only exported when a collector is configured
+	var exporter tracing.Exporter
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		exporter = &tracing.OTLPExporter{Endpoint: endpoint, ServiceName: "httpserver"}
+	}
+	tracer := tracing.NewTracer(exporter)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Println("Error flushing spans:", err)
+		}
+	}()
+	proxyClient := &http.Client{Transport: &tracing.Transport{Tracer: tracer}}
+
+	accessLog := accesslog.Middleware(accesslog.Options{
+		Logger: slog.New(accesslog.NewCombinedHandler(os.Stdout)),
+	})
+	// served over plain HTTP, where HSTS means nothing
+	securityOptions := secure.DefaultOptions()
+	securityOptions.HSTSMaxAge = 0
+
+	limits := ratelimit.NewMemoryStore(time.Minute)
+	defer limits.Close()
+	rateLimit := ratelimit.Middleware(ratelimit.Options{
+		Limiter: ratelimit.NewTokenBucket(10, 20, limits),
+	})
+	s, err := server.Serve(port, server.Chain(func(w *response.Writer, req *request.Request) *server.HandlerError {
 		body := request200()
 		status := response.StatusOK
 		h := response.GetDefaultHeaders(0)
+		path := req.Path()
 
-		if req.RequestLine.RequestTarget == "/yourproblem" {
+		if path == "/metrics" {
+			return metricsHandler(w, req)
+		} else if path == "/yourproblem" {
 			body = request400()
 			status = response.StatusBadRequest
-		} else if req.RequestLine.RequestTarget == "/myproblem" {
+		} else if path == "/myproblem" {
 			body = request500()
 			status = response.StatusInternalServerError
-		} else if req.RequestLine.RequestTarget == "/video" {
-			f, _ := os.ReadFile("assets/vim.mp4")
+		} else if path == "/video" {
+			f, err := os.ReadFile("assets/vim.mp4")
+			if err != nil {
+				return newHandlerError(response.StatusInternalServerError, err.Error())
+			}
 			h.Replace("Content-Type", "video/mp4")
 			h.Replace("Content-Length", fmt.Sprintf("%d", len(f)))
 			w.WriteStatusLine(response.StatusOK)
 			w.WriteHeaders(h)
 			w.WriteBody(f)
 			return nil
-		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+		} else if path == "/events" {
+			stream, err := sse.NewStream(w, req, sse.Options{})
+			if err != nil {
+				return newHandlerError(response.StatusInternalServerError, err.Error())
+			}
+			defer stream.Close()
+			for i := 1; i <= 5; i++ {
+				err := stream.Send(sse.Event{ID: fmt.Sprintf("%d", i), Event: "progress", Data: fmt.Sprintf("%d%%", i*20)})
+				if err != nil {
+					return nil
+				}
+				time.Sleep(time.Second)
+			}
+			return nil
+		} else if path == "/ws" {
+			c, err := websocket.Upgrade(w, req, websocket.UpgradeOptions{EnableCompression: true})
+			if err != nil {
+				return newHandlerError(response.StatusBadRequest, err.Error())
+			}
+			go func() {
+				defer c.Close(websocket.CloseNormalClosure, "")
+				for {
+					msgType, data, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err := c.WriteMessage(msgType, data); err != nil {
+						return
+					}
+				}
+			}()
+			return nil
+		} else if strings.HasPrefix(path, "/httpbin/") {
+			// the raw target, so the query string is proxied too
 			target := req.RequestLine.RequestTarget
-			res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
-			fmt.Printf("httpbin.org endpoint we're hitting %s\n", target[len("/httpbin/"):])
+			outbound, err := http.NewRequestWithContext(req.Context(), "GET", "https://httpbin.org/"+target[len("/httpbin/"):], nil)
+			if err != nil {
+				return newHandlerError(response.StatusBadRequest, err.Error())
+			}
+			res, err := proxyClient.Do(outbound)
+			slog.Debug("proxying to httpbin.org", "endpoint", target[len("/httpbin/"):])
 			if err != nil {
 				return &server.HandlerError{
 					StatusCode: response.StatusInternalServerError,
 					Message:    err.Error(),
 				}
 			}
-			h.Delete("Content-Length")
-			h.Set("Transfer-Encoding", "chunked")
+			defer res.Body.Close()
 			h.Replace("Content-Type", "text/plain")
-			h.Set("Trailer", "X-Content-SHA256")
-			h.Set("Trailer", "X-Content-Length")
+			w.DeclareTrailer(headers.CONTENT_DIGEST, "X-Content-Length")
 			w.WriteStatusLine(status)
 			w.WriteHeaders(h)
 
@@ -89,18 +186,13 @@ func main() {
 				if err != nil {
 					break
 				}
-				w.WriteBody(fmt.Appendf([]byte{}, "%x\r\n", n))
+				// the writer buffers, so small reads don't each cost a syscall
 				w.WriteBody(buf[:n])
-				w.WriteBody([]byte("\r\n"))
 				fullBody = append(fullBody, buf[:n]...)
 			}
-			w.WriteBody([]byte("0\r\n"))
-			trailers := headers.NewHeaders()
 			out := sha256.Sum256(fullBody)
-			trailers.Set("X-Content-SHA256", toString(out[:]))
-			trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-			w.WriteHeaders(trailers)
-			w.WriteBody([]byte("\r\n"))
+			w.SetTrailer(headers.CONTENT_DIGEST, headers.FormatDigest(headers.DIGEST_SHA256, out[:]))
+			w.SetTrailer("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
 			return nil
 		}
 
@@ -108,7 +200,6 @@ func main() {
 		if err != nil {
 			return newHandlerError(response.StatusInternalServerError, err.Error())
 		}
-		h.Replace("Content-Length", fmt.Sprintf("%d", len(body)))
 		h.Replace("Content-Type", "text/html")
 		err = w.WriteHeaders(h)
 		if err != nil {
@@ -119,7 +210,11 @@ func main() {
 			return newHandlerError(response.StatusInternalServerError, err.Error())
 		}
 		return nil
-	})
+	}, accessLog, httpMetrics.Middleware(route), tracing.Middleware(tracer), secure.Middleware(securityOptions), rateLimit), append(httpMetrics.ServerOptions(),
+		server.WithMaxConns(1024),
+		server.WithMaxConnsPerIP(64),
+		server.WithOverloadMode(server.OverloadReject),
+	)...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
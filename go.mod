@@ -2,7 +2,10 @@ module build-http-protocol
 
 go 1.24.1
 
-require github.com/stretchr/testify v1.11.1
+require (
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.48.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,127 @@
+package accesslog
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"os"
+	"time"
+)
+
+// attribute keys every access log record carries
+const (
+	KEY_REMOTE_ADDR = "remote_addr"
+	KEY_METHOD      = "method"
+	KEY_TARGET      = "target"
+	KEY_PROTO       = "proto"
+	KEY_STATUS      = "status"
+	KEY_BYTES       = "bytes"
+	KEY_DURATION    = "duration"
+	KEY_USER_AGENT  = "user_agent"
+	KEY_REFERER     = "referer"
+	KEY_REQUEST_ID  = "request_id"
+)
+
+const DEFAULT_REQUEST_ID_HEADER = "X-Request-ID"
+
+// longest incoming request ID we trust, anything else gets replaced
+const MAX_REQUEST_ID_LENGTH = 128
+
+type Options struct {
+	// Logger receives one record per request. It defaults to the Common
+	// Log Format on stdout; see NewCommonHandler, NewCombinedHandler and
+	// slog.NewJSONHandler.
+	Logger *slog.Logger
+	// SampleRate is the fraction of requests logged, between 0 and 1.
+	// Zero logs everything. Server errors are always logged.
+	SampleRate float64
+	// RequestIDHeader is read for an incoming request ID and echoed on the
+	// response. Defaults to X-Request-ID.
+	RequestIDHeader string
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID the middleware assigned to req.
+func RequestID(req *request.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *Options) sampled(status response.StatusCode) bool {
+	if o.SampleRate <= 0 || o.SampleRate >= 1 || status >= 500 {
+		return true
+	}
+	return mathrand.Float64() < o.SampleRate
+}
+
+// Middleware writes an access log record for every request once its
+// response is complete, and tags each request with a request ID.
+func Middleware(opts Options) server.Middleware {
+	if opts.Logger == nil {
+		opts.Logger = slog.New(NewCommonHandler(os.Stdout))
+	}
+	if opts.RequestIDHeader == "" {
+		opts.RequestIDHeader = DEFAULT_REQUEST_ID_HEADER
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			start := time.Now()
+			id, _ := req.Headers.Get(opts.RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				h.Replace(opts.RequestIDHeader, id)
+			})
+			w.OnFinish(func() {
+				if !opts.sampled(w.Status()) {
+					return
+				}
+				method := req.OriginalMethod()
+				userAgent, _ := req.Headers.Get("user-agent")
+				referer, _ := req.Headers.Get("referer")
+				opts.Logger.LogAttrs(req.Context(), slog.LevelInfo, "request",
+					slog.String(KEY_REMOTE_ADDR, req.RemoteAddr),
+					slog.String(KEY_METHOD, method),
+					slog.String(KEY_TARGET, req.RequestLine.RequestTarget),
+					slog.String(KEY_PROTO, "HTTP/"+req.RequestLine.HttpVersion),
+					slog.Int(KEY_STATUS, int(w.Status())),
+					slog.Int64(KEY_BYTES, w.ContentBytesWritten()),
+					slog.Duration(KEY_DURATION, time.Since(start)),
+					slog.String(KEY_USER_AGENT, userAgent),
+					slog.String(KEY_REFERER, referer),
+					slog.String(KEY_REQUEST_ID, id),
+				)
+			})
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w *response.Writer, req *request.Request) *server.HandlerError {
+	w.WriteToResponse([]byte("hello world"))
+	return nil
+}
+
+func run(t *testing.T, opts Options, handler server.Handler, method, extra string) string {
+	req, err := request.RequestFromReader(strings.NewReader(method + " /greet?x=1 HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.7:51234"
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, Middleware(opts)(handler)(w, req))
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestCommonLogFormat(t *testing.T) {
+	var log bytes.Buffer
+	opts := Options{Logger: slog.New(NewCommonHandler(&log))}
+
+	// Test: one CLF line per request
+	out := run(t, opts, hello, "GET", "User-Agent: curl/8.0\r\n")
+	line := log.String()
+	assert.True(t, strings.HasPrefix(line, "10.0.0.7 - - ["))
+	assert.True(t, strings.HasSuffix(line, "] \"GET /greet?x=1 HTTP/1.1\" 200 11\n"))
+
+	// Test: the response carries a generated request ID
+	assert.Regexp(t, `x-request-id: [0-9a-f]{16}\r\n`, out)
+
+	// Test: Combined adds referer and user agent
+	log.Reset()
+	opts = Options{Logger: slog.New(NewCombinedHandler(&log))}
+	run(t, opts, hello, "GET", "User-Agent: curl/8.0\r\n")
+	assert.True(t, strings.HasSuffix(log.String(), "200 11 \"-\" \"curl/8.0\"\n"))
+
+	// Test: chunked bodies log their content bytes, not the framing and trailers
+	log.Reset()
+	streaming := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("hello "))
+		w.Flush()
+		w.WriteBody([]byte("world"))
+		w.SetTrailer("X-Count", "2")
+		return nil
+	}
+	out = run(t, opts, streaming, "GET", "")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(log.String(), "200 11 \"-\" \"-\"\n"))
+}
+
+func TestJSONLog(t *testing.T) {
+	var log bytes.Buffer
+	opts := Options{Logger: slog.New(slog.NewJSONHandler(&log, nil))}
+	failing := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		assert.Equal(t, "abc-123", RequestID(req))
+		w.WriteStatusLine(response.StatusBadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("nope"))
+		return nil
+	}
+
+	// Test: records hold every field, and an incoming request ID is kept
+	out := run(t, opts, failing, "POST", "X-Request-ID: abc-123\r\nReferer: https://app.test/\r\n")
+	assert.Contains(t, out, "x-request-id: abc-123\r\n")
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(log.Bytes(), &record))
+	assert.Equal(t, "10.0.0.7:51234", record[KEY_REMOTE_ADDR])
+	assert.Equal(t, "POST", record[KEY_METHOD])
+	assert.Equal(t, "/greet?x=1", record[KEY_TARGET])
+	assert.Equal(t, "HTTP/1.1", record[KEY_PROTO])
+	assert.Equal(t, float64(400), record[KEY_STATUS])
+	assert.Equal(t, float64(4), record[KEY_BYTES])
+	assert.Equal(t, "https://app.test/", record[KEY_REFERER])
+	assert.Equal(t, "abc-123", record[KEY_REQUEST_ID])
+	assert.Contains(t, record, KEY_DURATION)
+
+	// Test: IDs that could break the log line are replaced
+	log.Reset()
+	run(t, opts, hello, "GET", "X-Request-ID: \"quoted\"\r\n")
+	require.NoError(t, json.Unmarshal(log.Bytes(), &record))
+	assert.Len(t, record[KEY_REQUEST_ID], 16)
+}
+
+func TestSampling(t *testing.T) {
+	var log bytes.Buffer
+	opts := Options{Logger: slog.New(NewCommonHandler(&log)), SampleRate: 0.000001}
+	broken := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusInternalServerError)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+
+	// Test: sampled out requests aren't logged, server errors always are
+	for i := 0; i < 10; i++ {
+		run(t, opts, hello, "GET", "")
+	}
+	assert.Empty(t, log.String())
+	run(t, opts, broken, "GET", "")
+	assert.Contains(t, log.String(), "\" 500 -\n")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Test: writes past maxSize move the log aside, keeping maxBackups files
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	current, _ := os.ReadFile(path)
+	backup1, _ := os.ReadFile(path + ".1")
+	backup2, _ := os.ReadFile(path + ".2")
+	assert.Equal(t, "fourth\n", string(current))
+	assert.Equal(t, "third\n", string(backup1))
+	assert.Equal(t, "second\n", string(backup2))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: when the log can't be moved aside it keeps growing in place
+	path = filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "taken"), 0o755))
+	g, err := NewRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer g.Close()
+	_, err = g.Write([]byte("first\n"))
+	require.NoError(t, err)
+	n, err := g.Write([]byte("second\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 7, n)
+	_, err = g.Write([]byte("third\n"))
+	assert.Error(t, err)
+	current, _ = os.ReadFile(path)
+	assert.Equal(t, "first\nsecond\nthird\n", string(current))
+}
@@ -0,0 +1,105 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_LOG_SIZE    = 100 << 20
+	DEFAULT_MAX_LOG_BACKUPS = 5
+)
+
+// RotatingFile is an io.Writer over a log file that is rotated once it
+// grows past MaxSize: path becomes path.1, path.1 becomes path.2 and so
+// on, keeping at most MaxBackups old files.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens (or appends to) the log at path. A maxSize or
+// maxBackups of 0 uses the defaults.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_LOG_SIZE
+	}
+	if maxBackups <= 0 {
+		maxBackups = DEFAULT_MAX_LOG_BACKUPS
+	}
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		// keep logging to the file we just closed rather than to nothing
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		// an earlier rotation couldn't reopen the log
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	// a single record larger than maxSize still gets written, on its own
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if rotateErr = r.rotate(); r.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		// the record made it, but the caller should hear rotation failed
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"fmt"
+	"strings"
+)
+
+type contextKey struct{}
+
+var ERROR_MISSING_CREDENTIALS = fmt.Errorf("missing credentials")
+var ERROR_INVALID_CREDENTIALS = fmt.Errorf("invalid credentials")
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	// Name is the user name, the token subject or the signing key ID
+	Name   string
+	Scheme string
+	// Claims holds a JWT's claims, nil for other schemes
+	Claims map[string]any
+}
+
+// Authorizer decides whether an authenticated principal may make the
+// request. Refusing it answers 403 Forbidden rather than 401, since
+// other credentials wouldn't change the outcome.
+type Authorizer func(p *Principal, req *request.Request) bool
+
+// FromRequest returns the principal the auth middleware attached, or nil
+// when the request wasn't authenticated.
+func FromRequest(req *request.Request) *Principal {
+	p, _ := req.Context().Value(contextKey{}).(*Principal)
+	return p
+}
+
+func withPrincipal(req *request.Request, p *Principal) *request.Request {
+	return req.WithContext(context.WithValue(req.Context(), contextKey{}, p))
+}
+
+// credentials returns the request's credentials if they use scheme, which
+// is matched case-insensitively.
+func credentials(req *request.Request, scheme string) (*headers.Credentials, error) {
+	value, ok := req.Headers.Get("Authorization")
+	if !ok {
+		return nil, ERROR_MISSING_CREDENTIALS
+	}
+	c, err := headers.ParseAuthorization(value)
+	if err != nil {
+		return nil, ERROR_INVALID_CREDENTIALS
+	}
+	if !strings.EqualFold(c.Scheme, scheme) {
+		return nil, ERROR_MISSING_CREDENTIALS
+	}
+	return c, nil
+}
+
+// deny answers status with the given challenge. A 401 always carries one,
+// as RFC 9110 requires; a 403 only when the scheme defines one.
+func deny(w *response.Writer, status response.StatusCode, challenge headers.Challenge) *server.HandlerError {
+	message := response.StatusText(status)
+	h := response.GetDefaultHeaders(len(message))
+	if challenge.Scheme != "" {
+		h.Replace("WWW-Authenticate", challenge.String())
+	}
+	if err := w.WriteStatusLine(status); err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+	}
+	w.WriteBody([]byte(message))
+	return nil
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func whoami(w *response.Writer, req *request.Request) *server.HandlerError {
+	w.WriteToResponse([]byte("hello " + FromRequest(req).Name))
+	return nil
+}
+
+func run(t *testing.T, mw server.Middleware, method, extra, body string) string {
+	raw := method + " /private HTTP/1.1\r\nHost: localhost\r\n" + extra
+	if body != "" {
+		raw += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n" + body))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, mw(whoami)(w, req))
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func basicAuth(user, password string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+}
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	file := "# users\nalice:" + string(hash) + "\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	require.NoError(t, os.WriteFile(path, []byte(file), 0o600))
+
+	// Test: bcrypt and {SHA} entries both verify
+	h, err := LoadHtpasswd(path)
+	require.NoError(t, err)
+	assert.True(t, h.Verify("alice", "s3cret"))
+	assert.False(t, h.Verify("alice", "wrong"))
+	assert.True(t, h.Verify("bob", "password"))
+	assert.False(t, h.Verify("bob", "Password"))
+	assert.False(t, h.Verify("carol", "s3cret"))
+
+	// Test: unsupported and malformed entries are refused on load
+	_, err = ParseHtpasswd(strings.NewReader("dave:$apr1$salt$hash\n"))
+	assert.ErrorIs(t, err, ERROR_UNSUPPORTED_HASH)
+	_, err = ParseHtpasswd(strings.NewReader("no colon here\n"))
+	assert.ErrorIs(t, err, ERROR_MALFORMED_HTPASSWD)
+	_, err = ParseHtpasswd(strings.NewReader("bob:{SHA}short\n"))
+	assert.ErrorIs(t, err, ERROR_MALFORMED_HTPASSWD)
+}
+
+func TestBasic(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\nmallory:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	require.NoError(t, err)
+	mw := BasicMiddleware(BasicOptions{
+		Realm:  "admin",
+		Verify: h.Verify,
+		Authorize: func(p *Principal, req *request.Request) bool {
+			return p.Name != "mallory"
+		},
+	})
+
+	// Test: no credentials gets a 401 with a challenge
+	out := run(t, mw, "GET", "", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+	assert.Contains(t, out, "www-authenticate: Basic realm=\"admin\", charset=\"UTF-8\"\r\n")
+
+	// Test: valid credentials reach the handler with a principal
+	out = run(t, mw, "GET", basicAuth("bob", "password"), "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "hello bob")
+
+	// Test: the scheme is case-insensitive, passwords may contain colons
+	h2, _ := ParseHtpasswd(strings.NewReader("eve:{SHA}" + sha1Base64("a:b") + "\n"))
+	out = run(t, BasicMiddleware(BasicOptions{Verify: h2.Verify}), "GET",
+		"Authorization: basic "+base64.StdEncoding.EncodeToString([]byte("eve:a:b"))+"\r\n", "")
+	assert.Contains(t, out, "hello eve")
+
+	// Test: wrong passwords, garbage and other schemes are 401
+	for _, extra := range []string{basicAuth("bob", "nope"), "Authorization: Basic !!!\r\n", "Authorization: Bearer abc\r\n"} {
+		out = run(t, mw, "GET", extra, "")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"), extra)
+	}
+
+	// Test: a known user who isn't allowed in gets 403 without a challenge
+	out = run(t, mw, "GET", basicAuth("mallory", "password"), "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	assert.NotContains(t, out, "www-authenticate")
+}
+
+func sha1Base64(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func jwt(t *testing.T, alg string, claims map[string]any, signer func(input string) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signer(input))
+}
+
+func hs256(secret string) func(string) []byte {
+	return func(input string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(input))
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := NewHS256Verifier([]byte("secret"))
+	v.Audience = "api"
+	v.Issuer = "https://issuer.example"
+	v.now = func() time.Time { return now }
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "aud": "api", "iss": "https://issuer.example", "exp": now.Unix() + 60}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return c
+	}
+
+	// Test: a valid token names its subject and carries the claims
+	p, err := v.Verify(jwt(t, "HS256", claims(nil), hs256("secret")))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", p.Name)
+	assert.Equal(t, "https://issuer.example", p.Claims["iss"])
+
+	// Test: aud may be an array
+	_, err = v.Verify(jwt(t, "HS256", claims(map[string]any{"aud": []string{"other", "api"}}), hs256("secret")))
+	assert.NoError(t, err)
+
+	// Test: claim and signature failures
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{jwt(t, "HS256", claims(nil), hs256("wrong")), ERROR_INVALID_SIGNATURE},
+		{jwt(t, "none", claims(nil), func(string) []byte { return nil }), ERROR_UNSUPPORTED_ALGORITHM},
+		{jwt(t, "RS256", claims(nil), hs256("secret")), ERROR_UNSUPPORTED_ALGORITHM},
+		{jwt(t, "HS256", claims(map[string]any{"exp": now.Unix() - 31}), hs256("secret")), ERROR_TOKEN_EXPIRED},
+		{jwt(t, "HS256", claims(map[string]any{"nbf": now.Unix() + 31}), hs256("secret")), ERROR_TOKEN_NOT_YET_VALID},
+		{jwt(t, "HS256", claims(map[string]any{"aud": "other"}), hs256("secret")), ERROR_WRONG_AUDIENCE},
+		{jwt(t, "HS256", claims(map[string]any{"iss": "evil"}), hs256("secret")), ERROR_WRONG_ISSUER},
+		{jwt(t, "HS256", claims(map[string]any{"exp": "soon"}), hs256("secret")), ERROR_MALFORMED_TOKEN},
+		{"not.a.jwt", ERROR_MALFORMED_TOKEN},
+		{"abc", ERROR_MALFORMED_TOKEN},
+	}
+	for _, c := range cases {
+		_, err := v.Verify(c.token)
+		assert.Equal(t, c.err, err, c.token)
+	}
+
+	// Test: exp and nbf within the leeway are still accepted
+	_, err = v.Verify(jwt(t, "HS256", claims(map[string]any{"exp": now.Unix() - 29, "nbf": now.Unix() + 29}), hs256("secret")))
+	assert.NoError(t, err)
+}
+
+func TestRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	public, err := ParseRSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+	rs256 := func(k *rsa.PrivateKey) func(string) []byte {
+		return func(input string) []byte {
+			digest := sha256.Sum256([]byte(input))
+			sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+			require.NoError(t, err)
+			return sig
+		}
+	}
+	v := NewRS256Verifier(public)
+
+	// Test: tokens signed with the private key verify
+	p, err := v.Verify(jwt(t, "RS256", map[string]any{"sub": "svc"}, rs256(key)))
+	require.NoError(t, err)
+	assert.Equal(t, "svc", p.Name)
+
+	// Test: HS256 signed with the public key bytes is refused
+	_, err = v.Verify(jwt(t, "HS256", map[string]any{"sub": "svc"}, hs256(string(der))))
+	assert.Equal(t, ERROR_UNSUPPORTED_ALGORITHM, err)
+
+	// Test: another key's signature is refused
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = v.Verify(jwt(t, "RS256", map[string]any{"sub": "svc"}, rs256(other)))
+	assert.Equal(t, ERROR_INVALID_SIGNATURE, err)
+
+	// Test: PKCS#1 keys load too
+	public, err = ParseRSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}))
+	require.NoError(t, err)
+	assert.True(t, public.Equal(&key.PublicKey))
+	_, err = ParseRSAPublicKey([]byte("garbage"))
+	assert.Equal(t, ERROR_INVALID_KEY, err)
+}
+
+func TestBearer(t *testing.T) {
+	v := NewHS256Verifier([]byte("secret"))
+	token := func(scope string) string {
+		return jwt(t, "HS256", map[string]any{"sub": "alice", "scope": scope}, hs256("secret"))
+	}
+	mw := BearerMiddleware(BearerOptions{Verifier: v, Scopes: []string{"read", "write"}})
+
+	// Test: no token is a bare challenge
+	out := run(t, mw, "GET", "", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+	assert.Contains(t, out, "www-authenticate: Bearer realm=\"restricted\"\r\n")
+
+	// Test: a bad token says why
+	out = run(t, mw, "GET", "Authorization: Bearer "+jwt(t, "HS256", map[string]any{}, hs256("wrong"))+"\r\n", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+	assert.Contains(t, out, `error="invalid_token", error_description="invalid token signature"`)
+
+	// Test: a malformed header is a bad request
+	out = run(t, mw, "GET", "Authorization: Bearer\r\n", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out, `error="invalid_request"`)
+
+	// Test: a valid token without the scopes is forbidden
+	out = run(t, mw, "GET", "Authorization: Bearer "+token("read")+"\r\n", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	assert.Contains(t, out, `error="insufficient_scope", scope="read write"`)
+
+	// Test: with all scopes the handler runs
+	out = run(t, mw, "GET", "Authorization: Bearer "+token("write admin read")+"\r\n", "")
+	assert.Contains(t, out, "hello alice")
+
+	// Test: static tokens
+	mw = BearerMiddleware(BearerOptions{Verifier: StaticTokens{"tok-1": "ci", "tok-2": "deploy"}})
+	out = run(t, mw, "GET", "Authorization: Bearer tok-2\r\n", "")
+	assert.Contains(t, out, "hello deploy")
+	out = run(t, mw, "GET", "Authorization: Bearer tok-3\r\n", "")
+	assert.Contains(t, out, " 401 ")
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mw := HMACMiddleware(HMACOptions{
+		Keys: map[string][]byte{"k1": []byte("shared")},
+		now:  func() time.Time { return now },
+	})
+	date := now.Format(headers.HTTP_DATE_FORMAT)
+	signed := func(method, date, body string, secret string) string {
+		return "Date: " + date + "\r\nAuthorization: " + SignRequest("k1", []byte(secret), method, "/private", date, []byte(body)) + "\r\n"
+	}
+
+	// Test: a correctly signed request goes through
+	out := run(t, mw, "POST", signed("POST", date, "hello", "shared"), "hello")
+	assert.Contains(t, out, "hello k1")
+
+	// Test: HEAD is signed as HEAD
+	out = run(t, mw, "HEAD", signed("HEAD", date, "", "shared"), "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: any change to method, body or key invalidates the signature
+	for _, extra := range []string{
+		signed("GET", date, "hello", "shared"),
+		signed("POST", date, "hellO", "shared"),
+		signed("POST", date, "hello", "other"),
+	} {
+		out = run(t, mw, "POST", extra, "hello")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+		assert.Contains(t, out, `HMAC-SHA256 realm="restricted", error="invalid credentials"`)
+	}
+
+	// Test: old requests can't be replayed
+	old := now.Add(-10 * time.Minute).Format(headers.HTTP_DATE_FORMAT)
+	out = run(t, mw, "POST", signed("POST", old, "hello", "shared"), "hello")
+	assert.Contains(t, out, `error="request date outside the allowed skew"`)
+
+	// Test: unsigned requests get the bare challenge
+	out = run(t, mw, "GET", "", "")
+	assert.Contains(t, out, "www-authenticate: HMAC-SHA256 realm=\"restricted\"\r\n")
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"encoding/base64"
+	"strings"
+)
+
+const DEFAULT_REALM = "restricted"
+
+type BasicOptions struct {
+	// Realm defaults to DEFAULT_REALM
+	Realm string
+	// Verify checks a user name and password, e.g. Htpasswd.Verify
+	Verify    func(user, password string) bool
+	Authorize Authorizer
+}
+
+// parseBasic decodes Basic credentials, user and password being split at
+// the first colon as RFC 7617 requires.
+func parseBasic(c *headers.Credentials) (string, string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(c.Token68)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// BasicMiddleware requires HTTP Basic credentials from RFC 7617. Basic
+// auth sends the password with every request, so it belongs behind TLS.
+func BasicMiddleware(opts BasicOptions) server.Middleware {
+	if opts.Realm == "" {
+		opts.Realm = DEFAULT_REALM
+	}
+	challenge := headers.Challenge{Scheme: "Basic", Params: [][2]string{
+		{"realm", opts.Realm},
+		{"charset", "UTF-8"},
+	}}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			c, err := credentials(req, "Basic")
+			if err != nil {
+				return deny(w, response.StatusUnauthorized, challenge)
+			}
+			user, password, ok := parseBasic(c)
+			if !ok || !opts.Verify(user, password) {
+				return deny(w, response.StatusUnauthorized, challenge)
+			}
+
+			p := &Principal{Name: user, Scheme: "Basic"}
+			req = withPrincipal(req, p)
+			if opts.Authorize != nil && !opts.Authorize(p, req) {
+				return deny(w, response.StatusForbidden, headers.Challenge{})
+			}
+			return next(w, req)
+		}
+	}
+}
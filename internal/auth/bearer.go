@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+)
+
+// TokenVerifier checks a bearer token and says whom it belongs to.
+type TokenVerifier interface {
+	Verify(token string) (*Principal, error)
+}
+
+// StaticTokens maps fixed API tokens to the names they authenticate.
+type StaticTokens map[string]string
+
+func (st StaticTokens) Verify(token string) (*Principal, error) {
+	// every token is compared, in constant time, so the response time
+	// doesn't tell how close a guess was
+	got := sha256.Sum256([]byte(token))
+	var match *Principal
+	for known, name := range st {
+		want := sha256.Sum256([]byte(known))
+		if subtle.ConstantTimeCompare(got[:], want[:]) == 1 {
+			match = &Principal{Name: name, Scheme: "Bearer"}
+		}
+	}
+	if match == nil {
+		return nil, ERROR_INVALID_CREDENTIALS
+	}
+	return match, nil
+}
+
+type BearerOptions struct {
+	// Realm defaults to DEFAULT_REALM
+	Realm    string
+	Verifier TokenVerifier
+	// Scopes must all be granted by the token's "scope" or "scp" claim
+	Scopes    []string
+	Authorize Authorizer
+}
+
+// scopes returns what a token grants: OAuth puts them in a space separated
+// "scope" claim, some issuers in an "scp" array.
+func scopes(p *Principal) map[string]bool {
+	granted := map[string]bool{}
+	if s, ok := p.Claims["scope"].(string); ok {
+		for _, scope := range strings.Fields(s) {
+			granted[scope] = true
+		}
+	}
+	if list, ok := p.Claims["scp"].([]any); ok {
+		for _, scope := range list {
+			if s, ok := scope.(string); ok {
+				granted[s] = true
+			}
+		}
+	}
+	return granted
+}
+
+func hasScopes(p *Principal, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	granted := scopes(p)
+	for _, scope := range required {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// BearerMiddleware requires a bearer token as in RFC 6750. Missing or bad
+// tokens get 401, tokens lacking Scopes or refused by Authorize get 403,
+// each with the matching error in the WWW-Authenticate challenge.
+func BearerMiddleware(opts BearerOptions) server.Middleware {
+	if opts.Realm == "" {
+		opts.Realm = DEFAULT_REALM
+	}
+	challenge := func(params ...[2]string) headers.Challenge {
+		return headers.Challenge{Scheme: "Bearer", Params: append([][2]string{{"realm", opts.Realm}}, params...)}
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			c, err := credentials(req, "Bearer")
+			if err == ERROR_MISSING_CREDENTIALS {
+				return deny(w, response.StatusUnauthorized, challenge())
+			}
+			if err != nil || c.Token68 == "" {
+				return deny(w, response.StatusBadRequest, challenge([2]string{"error", "invalid_request"}))
+			}
+			p, err := opts.Verifier.Verify(c.Token68)
+			if err != nil {
+				return deny(w, response.StatusUnauthorized, challenge(
+					[2]string{"error", "invalid_token"},
+					[2]string{"error_description", err.Error()}))
+			}
+
+			req = withPrincipal(req, p)
+			if !hasScopes(p, opts.Scopes) || opts.Authorize != nil && !opts.Authorize(p, req) {
+				params := [][2]string{{"error", "insufficient_scope"}}
+				if len(opts.Scopes) > 0 {
+					params = append(params, [2]string{"scope", strings.Join(opts.Scopes, " ")})
+				}
+				return deny(w, response.StatusForbidden, challenge(params...))
+			}
+			return next(w, req)
+		}
+	}
+}
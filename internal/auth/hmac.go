@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+const HMAC_SCHEME = "HMAC-SHA256"
+const DEFAULT_MAX_SKEW = 5 * time.Minute
+
+var ERROR_STALE_REQUEST = fmt.Errorf("request date outside the allowed skew")
+
+// stringToSign is what the signature covers: the method, the target, the
+// Date header and a hash of the body, one per line.
+func stringToSign(method, target, date string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + target + "\n" + date + "\n" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sign(secret []byte, method, target, date string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign(method, target, date, body)))
+	return mac.Sum(nil)
+}
+
+// SignRequest returns the Authorization value for a request a client is
+// about to send. date must be the request's Date header.
+func SignRequest(keyID string, secret []byte, method, target, date string, body []byte) string {
+	return headers.Challenge{Scheme: HMAC_SCHEME, Params: [][2]string{
+		{"keyId", keyID},
+		{"signature", base64.StdEncoding.EncodeToString(sign(secret, method, target, date, body))},
+	}}.String()
+}
+
+type HMACOptions struct {
+	// Realm defaults to DEFAULT_REALM
+	Realm string
+	// Keys maps key IDs to their shared secrets
+	Keys map[string][]byte
+	// MaxSkew bounds how far the Date header may be from now, limiting how
+	// long a captured request can be replayed. Defaults to DEFAULT_MAX_SKEW.
+	MaxSkew   time.Duration
+	Authorize Authorizer
+
+	now func() time.Time
+}
+
+func (opts HMACOptions) verify(req *request.Request) (*Principal, error) {
+	c, err := credentials(req, HMAC_SCHEME)
+	if err != nil {
+		return nil, err
+	}
+	keyID, signature := c.Params["keyid"], c.Params["signature"]
+	secret, ok := opts.Keys[keyID]
+	if !ok || signature == "" {
+		return nil, ERROR_INVALID_CREDENTIALS
+	}
+	date, _ := req.Headers.Get("Date")
+	sent, err := time.Parse(headers.HTTP_DATE_FORMAT, date)
+	if err != nil {
+		return nil, ERROR_STALE_REQUEST
+	}
+	if skew := opts.now().Sub(sent); skew > opts.MaxSkew || skew < -opts.MaxSkew {
+		return nil, ERROR_STALE_REQUEST
+	}
+	got, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ERROR_INVALID_CREDENTIALS
+	}
+	if !hmac.Equal(got, sign(secret, req.OriginalMethod(), req.RequestLine.RequestTarget, date, []byte(req.Body))) {
+		return nil, ERROR_INVALID_CREDENTIALS
+	}
+	return &Principal{Name: keyID, Scheme: HMAC_SCHEME}, nil
+}
+
+// HMACMiddleware requires requests signed with a shared secret, see
+// SignRequest. Unlike Basic and Bearer credentials a signature is only
+// good for one method, target and body, and only for MaxSkew.
+func HMACMiddleware(opts HMACOptions) server.Middleware {
+	if opts.Realm == "" {
+		opts.Realm = DEFAULT_REALM
+	}
+	if opts.MaxSkew <= 0 {
+		opts.MaxSkew = DEFAULT_MAX_SKEW
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	challenge := func(params ...[2]string) headers.Challenge {
+		return headers.Challenge{Scheme: HMAC_SCHEME, Params: append([][2]string{{"realm", opts.Realm}}, params...)}
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			p, err := opts.verify(req)
+			if err == ERROR_MISSING_CREDENTIALS {
+				return deny(w, response.StatusUnauthorized, challenge())
+			}
+			if err != nil {
+				return deny(w, response.StatusUnauthorized, challenge([2]string{"error", err.Error()}))
+			}
+
+			req = withPrincipal(req, p)
+			if opts.Authorize != nil && !opts.Authorize(p, req) {
+				return deny(w, response.StatusForbidden, headers.Challenge{})
+			}
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ERROR_UNSUPPORTED_HASH = fmt.Errorf("unsupported password hash")
+var ERROR_MALFORMED_HTPASSWD = fmt.Errorf("malformed htpasswd line")
+
+// Htpasswd checks passwords against an Apache htpasswd file. Entries may
+// use bcrypt (htpasswd -B) or {SHA} (htpasswd -s); MD5 and crypt entries
+// are refused when loading rather than never matching.
+type Htpasswd struct {
+	users map[string]string
+	// a real bcrypt hash, checked for unknown users so they take as long
+	// as known ones
+	decoy string
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{users: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%w %d", ERROR_MALFORMED_HTPASSWD, n)
+		}
+		switch {
+		case isBcrypt(hash):
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("%w %d", ERROR_MALFORMED_HTPASSWD, n)
+			}
+			if h.decoy == "" {
+				h.decoy = hash
+			}
+		case strings.HasPrefix(hash, "{SHA}"):
+			sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):])
+			if err != nil || len(sum) != sha1.Size {
+				return nil, fmt.Errorf("%w %d", ERROR_MALFORMED_HTPASSWD, n)
+			}
+		default:
+			return nil, fmt.Errorf("%w for %q on line %d", ERROR_UNSUPPORTED_HASH, user, n)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify reports whether password belongs to user. It fits
+// BasicOptions.Verify.
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		if h.decoy != "" {
+			bcrypt.CompareHashAndPassword([]byte(h.decoy), []byte(password))
+		}
+		return false
+	}
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	want, _ := base64.StdEncoding.DecodeString(hash[len("{SHA}"):])
+	got := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(want, got[:]) == 1
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DEFAULT_LEEWAY = 30 * time.Second
+
+var ERROR_MALFORMED_TOKEN = fmt.Errorf("malformed token")
+var ERROR_UNSUPPORTED_ALGORITHM = fmt.Errorf("unsupported token algorithm")
+var ERROR_INVALID_SIGNATURE = fmt.Errorf("invalid token signature")
+var ERROR_TOKEN_EXPIRED = fmt.Errorf("token expired")
+var ERROR_TOKEN_NOT_YET_VALID = fmt.Errorf("token not valid yet")
+var ERROR_WRONG_AUDIENCE = fmt.Errorf("token not meant for this audience")
+var ERROR_WRONG_ISSUER = fmt.Errorf("token from an unexpected issuer")
+var ERROR_INVALID_KEY = fmt.Errorf("invalid RSA public key")
+
+// JWTVerifier checks JSON Web Tokens (RFC 7519) signed with HS256 or
+// RS256. The algorithm is fixed by the key the verifier was built with,
+// so a token can't pick a different one, "none" included.
+type JWTVerifier struct {
+	// Audience and Issuer, when set, must match the aud and iss claims
+	Audience string
+	Issuer   string
+	// Leeway allows for clock skew in exp and nbf, DEFAULT_LEEWAY by default
+	Leeway time.Duration
+
+	alg    string
+	secret []byte
+	key    *rsa.PublicKey
+	now    func() time.Time
+}
+
+func NewHS256Verifier(secret []byte) *JWTVerifier {
+	return &JWTVerifier{Leeway: DEFAULT_LEEWAY, alg: "HS256", secret: secret, now: time.Now}
+}
+
+func NewRS256Verifier(key *rsa.PublicKey) *JWTVerifier {
+	return &JWTVerifier{Leeway: DEFAULT_LEEWAY, alg: "RS256", key: key, now: time.Now}
+}
+
+// ParseRSAPublicKey reads a PEM encoded "PUBLIC KEY" or "RSA PUBLIC KEY".
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ERROR_INVALID_KEY
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, ERROR_INVALID_KEY
+	}
+	return rsaKey, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ERROR_MALFORMED_TOKEN
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return ERROR_MALFORMED_TOKEN
+	}
+	return nil
+}
+
+func (v *JWTVerifier) verifySignature(input string, sig []byte) error {
+	switch v.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ERROR_INVALID_SIGNATURE
+		}
+	case "RS256":
+		digest := sha256.Sum256([]byte(input))
+		if rsa.VerifyPKCS1v15(v.key, crypto.SHA256, digest[:], sig) != nil {
+			return ERROR_INVALID_SIGNATURE
+		}
+	}
+	return nil
+}
+
+// numericDate reads an exp, nbf or iat claim, which are seconds since the
+// epoch and may have a fraction.
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	raw, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return time.Time{}, false, ERROR_MALFORMED_TOKEN
+	}
+	secs, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, ERROR_MALFORMED_TOKEN
+	}
+	return time.Unix(0, 0).Add(time.Duration(secs * float64(time.Second))), true, nil
+}
+
+// aud may be a single string or an array of them
+func hasAudience(claims map[string]any, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any) error {
+	now := v.now()
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if ok && !now.Before(exp.Add(v.Leeway)) {
+		return ERROR_TOKEN_EXPIRED
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.Leeway).Before(nbf) {
+		return ERROR_TOKEN_NOT_YET_VALID
+	}
+	if v.Audience != "" && !hasAudience(claims, v.Audience) {
+		return ERROR_WRONG_AUDIENCE
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return ERROR_WRONG_ISSUER
+	}
+	return nil
+}
+
+// Verify checks the token's signature and its exp, nbf, aud and iss
+// claims. The principal is named after the sub claim.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ERROR_MALFORMED_TOKEN
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != v.alg {
+		return nil, ERROR_UNSUPPORTED_ALGORITHM
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ERROR_MALFORMED_TOKEN
+	}
+	if err := v.verifySignature(parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]any{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &Principal{Name: sub, Scheme: "Bearer", Claims: claims}, nil
+}
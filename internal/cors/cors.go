@@ -0,0 +1,208 @@
+package cors
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultMethods = []string{"GET", "HEAD", "POST"}
+
+var ERROR_WILDCARD_WITH_CREDENTIALS = fmt.Errorf("cors: AllowedOrigins \"*\" can't be combined with AllowCredentials")
+
+type Options struct {
+	// AllowedOrigins holds exact origins, "*" for any origin, or patterns
+	// with a single wildcard such as "https://*.example.com".
+	AllowedOrigins        []string
+	AllowedOriginPatterns []*regexp.Regexp
+	// AllowOriginFunc is consulted when no static rule matched.
+	AllowOriginFunc func(origin string, req *request.Request) bool
+
+	// AllowedMethods defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders lists request headers a preflight may ask for; "*"
+	// reflects whatever the browser asks for.
+	AllowedHeaders []string
+	ExposedHeaders []string
+	// AllowCredentials can't be combined with "*", which would give every
+	// site credentialed access.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight result, rounded up
+	// to whole seconds. Zero leaves the header out.
+	MaxAge time.Duration
+}
+
+// Validate reports option combinations that are unsafe.
+func (o Options) Validate() error {
+	if o.allowAll() && o.AllowCredentials {
+		return ERROR_WILDCARD_WITH_CREDENTIALS
+	}
+	return nil
+}
+
+func matchWildcard(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return pattern == origin
+	}
+	return len(origin) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+func (o *Options) allowAll() bool {
+	return slices.Contains(o.AllowedOrigins, "*")
+}
+
+func (o *Options) originAllowed(origin string, req *request.Request) bool {
+	if o.allowAll() {
+		return true
+	}
+	// sandboxed documents and file: pages all send "null", so only an
+	// explicit entry lets it through
+	if origin == "null" {
+		return slices.Contains(o.AllowedOrigins, "null")
+	}
+	for _, allowed := range o.AllowedOrigins {
+		if matchWildcard(strings.ToLower(allowed), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	for _, re := range o.AllowedOriginPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return o.AllowOriginFunc != nil && o.AllowOriginFunc(origin, req)
+}
+
+func (o *Options) methodAllowed(method string) bool {
+	return slices.Contains(o.AllowedMethods, strings.ToUpper(method))
+}
+
+func (o *Options) headersAllowed(requested []string) bool {
+	if slices.Contains(o.AllowedHeaders, "*") {
+		return true
+	}
+	for _, h := range requested {
+		if !slices.ContainsFunc(o.AllowedHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, h)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// allowOrigin sets Access-Control-Allow-Origin to the wildcard or the
+// request's origin.
+func (o *Options) allowOrigin(h *headers.Headers, origin string) {
+	if o.allowAll() {
+		h.Replace("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Replace("Access-Control-Allow-Origin", origin)
+	}
+	if o.AllowCredentials {
+		h.Replace("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// varyOrigin reports whether responses differ by Origin and so need a
+// Vary: Origin for caches.
+func (o *Options) varyOrigin() bool {
+	return !o.allowAll() || o.AllowCredentials
+}
+
+func (o *Options) preflight(w *response.Writer, req *request.Request, origin string) *server.HandlerError {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Vary", "Origin")
+	h.Set("Vary", "Access-Control-Request-Method")
+	h.Set("Vary", "Access-Control-Request-Headers")
+
+	method, _ := req.Headers.Get("access-control-request-method")
+	requestHeaders, _ := req.Headers.Get("access-control-request-headers")
+	requested := splitList(requestHeaders)
+
+	// a rejected preflight is still a successful response, the browser
+	// blocks the real request when the allow headers are missing
+	if o.originAllowed(origin, req) && o.methodAllowed(method) && o.headersAllowed(requested) {
+		o.allowOrigin(h, origin)
+		h.Replace("Access-Control-Allow-Methods", strings.Join(o.AllowedMethods, ", "))
+		if len(requested) > 0 {
+			if slices.Contains(o.AllowedHeaders, "*") && !o.AllowCredentials {
+				h.Replace("Access-Control-Allow-Headers", "*")
+			} else {
+				h.Replace("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+			}
+		}
+		if o.MaxAge > 0 {
+			h.Replace("Access-Control-Max-Age", strconv.Itoa(int((o.MaxAge+time.Second-1)/time.Second)))
+		}
+	}
+
+	if err := w.WriteStatusLine(response.StatusNoContent); err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+	}
+	return nil
+}
+
+// Middleware answers CORS preflight requests itself and adds the CORS
+// response headers to every other cross-origin request it passes on. It
+// panics if opts don't pass Validate.
+func Middleware(opts Options) server.Middleware {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = defaultMethods
+	}
+	methods := []string{}
+	for _, m := range opts.AllowedMethods {
+		methods = append(methods, strings.ToUpper(m))
+	}
+	opts.AllowedMethods = methods
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			origin, hasOrigin := req.Headers.Get("origin")
+			_, isPreflight := req.Headers.Get("access-control-request-method")
+			if hasOrigin && isPreflight && req.RequestLine.Method == "OPTIONS" {
+				return opts.preflight(w, req, origin)
+			}
+
+			allowed := hasOrigin && opts.originAllowed(origin, req)
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				if opts.varyOrigin() {
+					h.Set("Vary", "Origin")
+				}
+				if !allowed {
+					return
+				}
+				opts.allowOrigin(h, origin)
+				if len(opts.ExposedHeaders) > 0 {
+					h.Replace("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+				}
+			})
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package cors
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ok(w *response.Writer, req *request.Request) *server.HandlerError {
+	w.WriteToResponse([]byte("ok"))
+	return nil
+}
+
+func run(t *testing.T, opts Options, method, extra string) string {
+	req, err := request.RequestFromReader(strings.NewReader(method + " /api HTTP/1.1\r\nHost: api.test\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, Middleware(opts)(ok)(w, req))
+	w.Finish()
+	return buf.String()
+}
+
+func TestSimpleRequests(t *testing.T) {
+	opts := Options{AllowedOrigins: []string{"https://app.test"}, ExposedHeaders: []string{"X-Total"}}
+
+	// Test: allowed origin
+	out := run(t, opts, "GET", "Origin: https://app.test\r\n")
+	assert.Contains(t, out, "access-control-allow-origin: https://app.test\r\n")
+	assert.Contains(t, out, "access-control-expose-headers: X-Total\r\n")
+	assert.Contains(t, out, "vary: Origin\r\n")
+
+	// Test: other origins get no allow header but still Vary
+	out = run(t, opts, "GET", "Origin: https://evil.test\r\n")
+	assert.NotContains(t, out, "access-control-allow-origin")
+	assert.Contains(t, out, "vary: Origin\r\n")
+
+	// Test: same-origin requests pass through untouched
+	out = run(t, opts, "GET", "")
+	assert.NotContains(t, out, "access-control-allow-origin")
+
+	// Test: "*" needs no Vary
+	out = run(t, Options{AllowedOrigins: []string{"*"}}, "GET", "Origin: https://any.test\r\n")
+	assert.Contains(t, out, "access-control-allow-origin: *\r\n")
+	assert.NotContains(t, out, "vary")
+
+	// Test: credentials echo the listed origin, and can't be used with "*"
+	out = run(t, Options{AllowedOrigins: []string{"https://app.test"}, AllowCredentials: true}, "GET", "Origin: https://app.test\r\n")
+	assert.Contains(t, out, "access-control-allow-origin: https://app.test\r\n")
+	assert.Contains(t, out, "access-control-allow-credentials: true\r\n")
+	assert.Contains(t, out, "vary: Origin\r\n")
+	wildcard := Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	assert.Equal(t, ERROR_WILDCARD_WITH_CREDENTIALS, wildcard.Validate())
+	assert.Panics(t, func() { Middleware(wildcard) })
+
+	// Test: the "null" origin needs an explicit entry
+	out = run(t, Options{AllowedOrigins: []string{"*.test"}, AllowCredentials: true}, "GET", "Origin: null\r\n")
+	assert.NotContains(t, out, "access-control-allow-origin")
+	out = run(t, Options{AllowedOrigins: []string{"null"}}, "GET", "Origin: null\r\n")
+	assert.Contains(t, out, "access-control-allow-origin: null\r\n")
+}
+
+func TestOriginMatching(t *testing.T) {
+	opts := Options{
+		AllowedOrigins:        []string{"https://*.example.com"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+		AllowOriginFunc: func(origin string, req *request.Request) bool {
+			return origin == "https://partner.test"
+		},
+	}
+	assert.True(t, opts.originAllowed("https://app.example.com", nil))
+	assert.False(t, opts.originAllowed("https://example.com", nil))
+	assert.False(t, opts.originAllowed("https://app.example.com.evil.test", nil))
+	assert.True(t, opts.originAllowed("http://localhost:5173", nil))
+	assert.False(t, opts.originAllowed("http://localhost:5173.evil.test", nil))
+	assert.True(t, opts.originAllowed("https://partner.test", nil))
+	assert.False(t, opts.originAllowed("https://other.test", nil))
+}
+
+func TestPreflight(t *testing.T) {
+	opts := Options{
+		AllowedOrigins: []string{"https://app.test"},
+		AllowedMethods: []string{"get", "put"},
+		AllowedHeaders: []string{"Content-Type", "X-Request-Id"},
+		MaxAge:         10 * time.Minute,
+	}
+
+	// Test: allowed preflight is answered without calling the handler
+	out := run(t, opts, "OPTIONS", "Origin: https://app.test\r\nAccess-Control-Request-Method: PUT\r\nAccess-Control-Request-Headers: content-type, x-request-id\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, out, "access-control-allow-origin: https://app.test\r\n")
+	assert.Contains(t, out, "access-control-allow-methods: GET, PUT\r\n")
+	assert.Contains(t, out, "access-control-allow-headers: content-type, x-request-id\r\n")
+	assert.Contains(t, out, "access-control-max-age: 600\r\n")
+	assert.Contains(t, out, "vary: Origin,Access-Control-Request-Method,Access-Control-Request-Headers\r\n")
+	assert.NotContains(t, out, "ok")
+
+	// Test: disallowed method or header gets no allow headers
+	out = run(t, opts, "OPTIONS", "Origin: https://app.test\r\nAccess-Control-Request-Method: DELETE\r\n")
+	assert.NotContains(t, out, "access-control-allow-origin")
+	out = run(t, opts, "OPTIONS", "Origin: https://app.test\r\nAccess-Control-Request-Method: PUT\r\nAccess-Control-Request-Headers: X-Secret\r\n")
+	assert.NotContains(t, out, "access-control-allow-origin")
+
+	// Test: a MaxAge under a second rounds up instead of disabling caching
+	opts.MaxAge = 500 * time.Millisecond
+	out = run(t, opts, "OPTIONS", "Origin: https://app.test\r\nAccess-Control-Request-Method: PUT\r\n")
+	assert.Contains(t, out, "access-control-max-age: 1\r\n")
+
+	// Test: plain OPTIONS goes to the handler
+	out = run(t, opts, "OPTIONS", "Origin: https://app.test\r\n")
+	assert.Contains(t, out, "ok")
+}
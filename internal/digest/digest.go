@@ -0,0 +1,117 @@
+package digest
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"hash"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Options struct {
+	// Field is headers.CONTENT_DIGEST (the default) or headers.REPR_DIGEST.
+	// Without range requests or content codings applied by the writer the
+	// two cover the same bytes.
+	Field string
+	// Algorithms the server is willing to send, defaults to sha-256.
+	Algorithms []string
+	// Trailer sends the digest as a declared trailer whenever the client
+	// accepts trailers. Otherwise it goes in the header when the whole body
+	// fit in the write buffer, and in a trailer when it had to be streamed.
+	// A larger body with a Content-Length has room for neither and gets no
+	// digest.
+	Trailer bool
+}
+
+// algorithms picks what to send: everything configured, or the client's
+// most preferred configured algorithm when it sent Want-*-Digest.
+func (o *Options) algorithms(req *request.Request) []string {
+	value, ok := req.Headers.Get("Want-" + o.Field)
+	if !ok {
+		return o.Algorithms
+	}
+	wanted, err := headers.ParseWantDigest(value)
+	if err != nil {
+		return o.Algorithms
+	}
+	for _, alg := range wanted {
+		if slices.Contains(o.Algorithms, alg) {
+			return []string{alg}
+		}
+	}
+	return nil
+}
+
+// Middleware computes a digest of the response body as the handler writes
+// it. Request digests are checked by the server itself, see
+// server.WithDigestVerification.
+func Middleware(opts Options) server.Middleware {
+	if opts.Field == "" {
+		opts.Field = headers.CONTENT_DIGEST
+	}
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{headers.DIGEST_SHA256}
+	}
+	algs := []string{}
+	for _, alg := range opts.Algorithms {
+		if alg = strings.ToLower(alg); headers.NewDigestHash(alg) != nil {
+			algs = append(algs, alg)
+		}
+	}
+	opts.Algorithms = algs
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			algs := opts.algorithms(req)
+			// a HEAD response has no content to digest
+			if len(algs) == 0 || (req.IsHead() && opts.Field == headers.CONTENT_DIGEST) {
+				return next(w, req)
+			}
+
+			hashes := make([]hash.Hash, len(algs))
+			for i, alg := range algs {
+				hashes[i] = headers.NewDigestHash(alg)
+			}
+			w.OnWriteBody(func(p []byte) {
+				for _, h := range hashes {
+					h.Write(p)
+				}
+			})
+			if opts.Trailer {
+				w.DeclareTrailer(opts.Field)
+			}
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				// a body that fits in the buffer is held back so the digest
+				// can still make it into the header; the writer puts the
+				// same Content-Length back. Larger bodies keep theirs.
+				length, ok := h.Get("Content-Length")
+				if n, err := strconv.Atoi(length); ok && err == nil && n <= w.BufferSize() {
+					h.Delete("Content-Length")
+				}
+			})
+
+			if err := next(w, req); err != nil {
+				return err
+			}
+			if !w.BodyObserved() {
+				// a digest of what we didn't see would be wrong
+				return nil
+			}
+
+			members := []string{}
+			for i, alg := range algs {
+				members = append(members, headers.FormatDigest(alg, hashes[i].Sum(nil)))
+			}
+			value := strings.Join(members, ", ")
+			if h := w.PendingHeaders(); h != nil && (!opts.Trailer || !w.SendsTrailers()) {
+				h.Replace(opts.Field, value)
+				return nil
+			}
+			w.SetTrailer(opts.Field, value)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package digest
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w *response.Writer, req *request.Request) *server.HandlerError {
+	w.WriteToResponse([]byte("hello world"))
+	return nil
+}
+
+func run(t *testing.T, opts Options, handler server.Handler, method, extra string) string {
+	req, err := request.RequestFromReader(strings.NewReader(method + " / HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetRequestMethod(req.RequestLine.Method)
+	w.SetAcceptsTrailers(strings.Contains(extra, "TE: trailers"))
+	if req.RequestLine.Method == "HEAD" {
+		req = req.AsGet()
+	}
+	require.Nil(t, Middleware(opts)(handler)(w, req))
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestDigestHeader(t *testing.T) {
+	sum256 := sha256.Sum256([]byte("hello world"))
+	sum512 := sha512.Sum512([]byte("hello world"))
+
+	// Test: small bodies carry the digest in the header
+	out := run(t, Options{}, hello, "GET", "")
+	assert.Contains(t, out, "content-digest: "+headers.FormatDigest("sha-256", sum256[:])+"\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+
+	// Test: several algorithms and Repr-Digest
+	out = run(t, Options{Field: headers.REPR_DIGEST, Algorithms: []string{"sha-256", "sha-512"}}, hello, "GET", "")
+	assert.Contains(t, out, "repr-digest: "+headers.FormatDigest("sha-256", sum256[:])+", "+headers.FormatDigest("sha-512", sum512[:])+"\r\n")
+
+	// Test: Want-Content-Digest picks the preferred algorithm
+	out = run(t, Options{Algorithms: []string{"sha-256", "sha-512"}}, hello, "GET", "Want-Content-Digest: sha-256=1, sha-512=5\r\n")
+	assert.Contains(t, out, "content-digest: "+headers.FormatDigest("sha-512", sum512[:])+"\r\n")
+
+	// Test: nothing acceptable means no digest
+	out = run(t, Options{}, hello, "GET", "Want-Content-Digest: sha-512=5\r\n")
+	assert.NotContains(t, out, "content-digest")
+
+	// Test: HEAD responses have no content to digest
+	out = run(t, Options{}, hello, "HEAD", "")
+	assert.NotContains(t, out, "content-digest")
+}
+
+func TestDigestTrailer(t *testing.T) {
+	body := strings.Repeat("x", 2*response.DEFAULT_WRITE_BUFFER_SIZE)
+	sum := sha256.Sum256([]byte(body))
+	stream := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		for i := 0; i < len(body); i += 1000 {
+			w.WriteBody([]byte(body[i:min(i+1000, len(body))]))
+		}
+		return nil
+	}
+
+	// Test: streamed bodies get the digest as a trailer
+	out := run(t, Options{}, stream, "GET", "TE: trailers\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "0\r\ncontent-digest: "+headers.FormatDigest("sha-256", sum[:])+"\r\n\r\n"))
+
+	// Test: Trailer mode announces the trailer even for small bodies
+	out = run(t, Options{Trailer: true}, hello, "GET", "TE: trailers\r\n")
+	assert.Contains(t, out, "trailer: Content-Digest\r\n")
+	assert.Contains(t, out, "\r\n0\r\ncontent-digest: ")
+
+	// Test: without TE: trailers it falls back to the header
+	out = run(t, Options{Trailer: true}, hello, "GET", "")
+	assert.NotContains(t, out, "trailer")
+	assert.Contains(t, out, "content-digest: ")
+
+	// Test: a known length too big to hold back stays, and the digest
+	// that can't follow it is left out
+	sized := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+		return nil
+	}
+	out = run(t, Options{}, sized, "GET", "")
+	assert.Contains(t, out, "content-length: "+strconv.Itoa(len(body))+"\r\n")
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.NotContains(t, out, "content-digest")
+}
+
+func TestDigestUnobserved(t *testing.T) {
+	// Test: a body the handler framed itself gets no digest
+	raw := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("5\r\nhello\r\n0\r\n\r\n"))
+		return nil
+	}
+	assert.NotContains(t, run(t, Options{}, raw, "GET", "TE: trailers\r\n"), "content-digest")
+
+	// Test: neither does a status without a body
+	empty := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(headers.NewHeaders())
+		return nil
+	}
+	assert.NotContains(t, run(t, Options{}, empty, "GET", ""), "content-digest")
+}
@@ -0,0 +1,140 @@
+package headers
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ERROR_MALFORMED_AUTHORIZATION = fmt.Errorf("malformed authorization field")
+
+// Credentials is an Authorization value from RFC 9110 section 11.4. Schemes
+// like Basic and Bearer send a single token68, others a list of auth-params.
+type Credentials struct {
+	Scheme  string
+	Token68 string
+	Params  map[string]string
+}
+
+func isToken68(str string) bool {
+	str = strings.TrimRight(str, "=")
+	if str == "" {
+		return false
+	}
+	for i := 0; i < len(str); i++ {
+		ch := str[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' {
+			continue
+		}
+		switch ch {
+		case '-', '.', '_', '~', '+', '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAuthorization splits an Authorization or Proxy-Authorization value
+// into its scheme and credentials. Parameter names are lowercased.
+func ParseAuthorization(value string) (*Credentials, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !isToken(scheme) {
+		return nil, ERROR_MALFORMED_AUTHORIZATION
+	}
+	c := &Credentials{Scheme: scheme}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return c, nil
+	}
+	if isToken68(rest) {
+		c.Token68 = rest
+		return c, nil
+	}
+	params, err := parseAuthParams(rest)
+	if err != nil {
+		return nil, err
+	}
+	c.Params = params
+	return c, nil
+}
+
+// parseAuthParams reads a comma separated list of name=value pairs whose
+// values are tokens or quoted strings.
+func parseAuthParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, ERROR_MALFORMED_AUTHORIZATION
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		if !isToken(name) {
+			return nil, ERROR_MALFORMED_AUTHORIZATION
+		}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, ERROR_MALFORMED_AUTHORIZATION
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+			if !isToken(value) {
+				return nil, ERROR_MALFORMED_AUTHORIZATION
+			}
+		}
+		if _, dup := params[name]; dup {
+			return nil, ERROR_MALFORMED_AUTHORIZATION
+		}
+		params[name] = value
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, ERROR_MALFORMED_AUTHORIZATION
+		}
+	}
+}
+
+// Challenge is one WWW-Authenticate challenge. Params are written in
+// order as name/value pairs, always quoted.
+type Challenge struct {
+	Scheme string
+	Params [][2]string
+}
+
+func quote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(value) + `"`
+}
+
+func (c Challenge) String() string {
+	var b strings.Builder
+	b.WriteString(c.Scheme)
+	for i, p := range c.Params {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteString(", ")
+		}
+		b.WriteString(p[0] + "=" + quote(p[1]))
+	}
+	return b.String()
+}
@@ -0,0 +1,210 @@
+package headers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ERROR_INVALID_COOKIE_NAME = fmt.Errorf("invalid cookie name")
+var ERROR_INVALID_COOKIE_VALUE = fmt.Errorf("invalid cookie value")
+var ERROR_INVALID_COOKIE_ATTRIBUTE = fmt.Errorf("invalid cookie attribute")
+var ERROR_COOKIE_TOO_LARGE = fmt.Errorf("cookie too large")
+
+// IMF-fixdate from RFC 9110, the only date format servers should send
+const HTTP_DATE_FORMAT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// limits from RFC 6265bis section 5.6
+const (
+	MAX_COOKIE_NAME_VALUE_SIZE = 4096
+	MAX_COOKIE_ATTRIBUTE_SIZE  = 1024
+)
+
+type SameSite string
+
+const (
+	SameSiteDefault SameSite = ""
+	SameSiteStrict  SameSite = "Strict"
+	SameSiteLax     SameSite = "Lax"
+	SameSiteNone    SameSite = "None"
+)
+
+type Cookie struct {
+	Name  string
+	Value string
+
+	Expires time.Time
+	// MaxAge > 0 sets Max-Age, MaxAge < 0 sends Max-Age=0 to delete the
+	// cookie and 0 leaves the attribute out.
+	MaxAge      int
+	Domain      string
+	Path        string
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+func isCookieOctet(ch byte) bool {
+	return ch == 0x21 || ch >= 0x23 && ch <= 0x2b || ch >= 0x2d && ch <= 0x3a ||
+		ch >= 0x3c && ch <= 0x5b || ch >= 0x5d && ch <= 0x7e
+}
+
+func isCookieValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAttributeValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] == 0x7f || value[i] == ';' {
+			return false
+		}
+	}
+	return len(value) <= MAX_COOKIE_ATTRIBUTE_SIZE
+}
+
+func isDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Cookie) Valid() error {
+	if !isToken(c.Name) {
+		return ERROR_INVALID_COOKIE_NAME
+	}
+	if !isCookieValue(c.Value) {
+		return ERROR_INVALID_COOKIE_VALUE
+	}
+	if len(c.Name)+len(c.Value) > MAX_COOKIE_NAME_VALUE_SIZE {
+		return ERROR_COOKIE_TOO_LARGE
+	}
+	if c.Domain != "" && !isDomain(c.Domain) {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+	if c.Path != "" && (!isAttributeValue(c.Path) || c.Path[0] != '/') {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	switch c.SameSite {
+	case SameSiteDefault, SameSiteStrict, SameSiteLax:
+	case SameSiteNone:
+		if !c.Secure {
+			return ERROR_INVALID_COOKIE_ATTRIBUTE
+		}
+	default:
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+	if c.Partitioned && !c.Secure {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+
+	// cookie name prefixes, matched case-insensitively per 6265bis
+	lower := strings.ToLower(c.Name)
+	if strings.HasPrefix(lower, "__secure-") && !c.Secure {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+	if strings.HasPrefix(lower, "__host-") && (!c.Secure || c.Domain != "" || c.Path != "/") {
+		return ERROR_INVALID_COOKIE_ATTRIBUTE
+	}
+	return nil
+}
+
+// String serializes the cookie as a Set-Cookie field value. It does not
+// validate; use Valid (or Headers.AddCookie) for that.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(c.Value)
+
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(HTTP_DATE_FORMAT))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(c.Path)
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=")
+		b.WriteString(string(c.SameSite))
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// ParseCookies parses a Cookie request field value into its name/value
+// pairs. Malformed pairs are skipped rather than failing the whole header,
+// which is what user agents expect from servers.
+func ParseCookies(value string) []*Cookie {
+	cookies := []*Cookie{}
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !isToken(name) || !isCookieValue(val) {
+			continue
+		}
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = val[1 : len(val)-1]
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: val})
+	}
+	return cookies
+}
+
+// Cookies returns every cookie sent in the Cookie fields of h.
+func (h *Headers) Cookies() []*Cookie {
+	cookies := []*Cookie{}
+	for _, v := range h.Values("cookie") {
+		cookies = append(cookies, ParseCookies(v)...)
+	}
+	return cookies
+}
+
+// AddCookie validates c and adds it as its own Set-Cookie field.
+func (h *Headers) AddCookie(c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	h.Set("Set-Cookie", c.String())
+	return nil
+}
@@ -0,0 +1,114 @@
+package headers
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ERROR_MALFORMED_DIGEST = fmt.Errorf("malformed digest field")
+
+// integrity fields from RFC 9530
+const (
+	CONTENT_DIGEST      = "Content-Digest"
+	REPR_DIGEST         = "Repr-Digest"
+	WANT_CONTENT_DIGEST = "Want-Content-Digest"
+	WANT_REPR_DIGEST    = "Want-Repr-Digest"
+)
+
+const (
+	DIGEST_SHA256 = "sha-256"
+	DIGEST_SHA512 = "sha-512"
+)
+
+// NewDigestHash returns the hash behind a digest algorithm, or nil if the
+// algorithm isn't supported.
+func NewDigestHash(alg string) hash.Hash {
+	switch strings.ToLower(alg) {
+	case DIGEST_SHA256:
+		return sha256.New()
+	case DIGEST_SHA512:
+		return sha512.New()
+	default:
+		return nil
+	}
+}
+
+// FormatDigest renders one dictionary member, e.g. sha-256=:base64:
+func FormatDigest(alg string, sum []byte) string {
+	return alg + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// splitMembers splits a structured field dictionary into key and value
+// pairs. Parameters aren't used by the digest fields, so they are dropped.
+func splitMembers(value string) ([][2]string, error) {
+	members := [][2]string{}
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			member = member[:i]
+		}
+		key, val, ok := strings.Cut(member, "=")
+		if !ok || key == "" {
+			return nil, ERROR_MALFORMED_DIGEST
+		}
+		members = append(members, [2]string{strings.ToLower(key), val})
+	}
+	return members, nil
+}
+
+// ParseDigests parses a Content-Digest or Repr-Digest value into the raw
+// digest bytes keyed by algorithm.
+func ParseDigests(value string) (map[string][]byte, error) {
+	members, err := splitMembers(value)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string][]byte{}
+	for _, m := range members {
+		val := m[1]
+		if len(val) < 2 || val[0] != ':' || val[len(val)-1] != ':' {
+			return nil, ERROR_MALFORMED_DIGEST
+		}
+		sum, err := base64.StdEncoding.DecodeString(val[1 : len(val)-1])
+		if err != nil {
+			return nil, ERROR_MALFORMED_DIGEST
+		}
+		digests[m[0]] = sum
+	}
+	return digests, nil
+}
+
+// ParseWantDigest returns the supported algorithms a Want-*-Digest value
+// asks for, most preferred first. Weight 0 means "not acceptable".
+func ParseWantDigest(value string) ([]string, error) {
+	members, err := splitMembers(value)
+	if err != nil {
+		return nil, err
+	}
+	weights := map[string]int{}
+	algs := []string{}
+	for _, m := range members {
+		weight, err := strconv.Atoi(m[1])
+		if err != nil || weight < 0 || weight > 10 {
+			return nil, ERROR_MALFORMED_DIGEST
+		}
+		if weight == 0 || NewDigestHash(m[0]) == nil {
+			continue
+		}
+		weights[m[0]] = weight
+		algs = append(algs, m[0])
+	}
+	sort.SliceStable(algs, func(i, j int) bool {
+		return weights[algs[i]] > weights[algs[j]]
+	})
+	return algs, nil
+}
@@ -9,6 +9,7 @@ import (
 var CRLF []byte = []byte("\r\n")
 var ERROR_MALFORMED_FIELD_LINE error = fmt.Errorf("malformed field line")
 var ERROR_MALFORMED_FIELD_NAME error = fmt.Errorf("malformed field name")
+var ERROR_MALFORMED_FIELD_VALUE error = fmt.Errorf("malformed field value")
 
 func isToken(str string) bool {
 	result := true
@@ -29,24 +30,46 @@ outer:
 	return result && len(str) > 0
 }
 
+// ValidFieldName reports whether name is a token, as Parse requires.
+func ValidFieldName(name string) bool {
+	return isToken(name)
+}
+
+// ValidFieldValue reports whether value is free of the CR, LF and NUL
+// bytes Parse refuses. Senders must check values that come from user
+// input, or the input can add fields of its own.
+func ValidFieldValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
+
 type Headers struct {
-	headers map[string]string
+	headers map[string][]string
+}
+
+// fields that must never be folded into a single comma separated line
+var unfoldable = map[string]bool{
+	"set-cookie": true,
 }
 
 func NewHeaders() *Headers {
 	return &Headers{
-		headers: map[string]string{},
+		headers: map[string][]string{},
 	}
 }
 
 func (h *Headers) Get(fieldName string) (string, bool) {
-	value, ok := h.headers[strings.ToLower(fieldName)]
-	return value, ok
+	values, ok := h.headers[strings.ToLower(fieldName)]
+	return strings.Join(values, ","), ok
+}
+
+// Values returns every value stored for fieldName in the order they were set.
+func (h *Headers) Values(fieldName string) []string {
+	return h.headers[strings.ToLower(fieldName)]
 }
 
 func (h *Headers) Replace(fieldName, fieldValue string) {
 	fieldName = strings.ToLower(fieldName)
-	h.headers[fieldName] = fieldValue
+	h.headers[fieldName] = []string{fieldValue}
 }
 
 func (h *Headers) Delete(fieldName string) {
@@ -56,17 +79,18 @@ func (h *Headers) Delete(fieldName string) {
 
 func (h *Headers) Set(fieldName, fieldValue string) {
 	fieldName = strings.ToLower(fieldName)
-	value, ok := h.headers[fieldName]
-	if !ok {
-		h.headers[fieldName] = fieldValue
-		return
-	}
-	h.headers[fieldName] = fmt.Sprintf("%s,%s", value, fieldValue)
+	h.headers[fieldName] = append(h.headers[fieldName], fieldValue)
 }
 
 func (h *Headers) ForEach(cb func(u, v string)) {
-	for k, v := range h.headers {
-		cb(k, v)
+	for k, values := range h.headers {
+		if unfoldable[k] {
+			for _, v := range values {
+				cb(k, v)
+			}
+			continue
+		}
+		cb(k, strings.Join(values, ","))
 	}
 }
 
@@ -82,6 +106,11 @@ func (h Headers) parseHeader(fieldLine []byte) (string, string, error) {
 	if bytes.HasSuffix(key, []byte(" ")) {
 		return "", "", ERROR_MALFORMED_FIELD_NAME
 	}
+	// a bare CR or LF would end the line for a more lenient parser
+	// upstream, letting a value smuggle in a field we never saw
+	if !ValidFieldValue(string(value)) {
+		return "", "", ERROR_MALFORMED_FIELD_VALUE
+	}
 
 	return string(key), string(value), nil
 }
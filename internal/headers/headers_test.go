@@ -1,7 +1,9 @@
 package headers
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -48,3 +50,207 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestSetCookieNotFolded(t *testing.T) {
+	headers := NewHeaders()
+	require.NoError(t, headers.AddCookie(&Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, headers.AddCookie(&Cookie{Name: "b", Value: "2"}))
+	headers.Set("Vary", "Origin")
+	headers.Set("Vary", "Accept")
+
+	lines := []string{}
+	headers.ForEach(func(n, v string) {
+		lines = append(lines, n+": "+v)
+	})
+	assert.ElementsMatch(t, []string{"set-cookie: a=1", "set-cookie: b=2", "vary: Origin,Accept"}, lines)
+}
+
+func TestParseCookies(t *testing.T) {
+	cookies := ParseCookies(`session=abc123; theme="dark"; bad cookie=1; empty=; =novalue`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "empty", cookies[2].Name)
+	assert.Equal(t, "", cookies[2].Value)
+
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("Cookie: a=1\r\nCookie: b=2; c=3\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Len(t, headers.Cookies(), 3)
+}
+
+func TestCookieString(t *testing.T) {
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Domain:      ".example.com",
+		Path:        "/docs",
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Domain=example.com; Path=/docs; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	c = &Cookie{Name: "gone", MaxAge: -1}
+	assert.Equal(t, "gone=; Max-Age=0", c.String())
+}
+
+func TestCookieValid(t *testing.T) {
+	tests := []struct {
+		cookie Cookie
+		err    error
+	}{
+		{Cookie{Name: "ok", Value: "v"}, nil},
+		{Cookie{Name: "bad name", Value: "v"}, ERROR_INVALID_COOKIE_NAME},
+		{Cookie{Name: "n", Value: "has space"}, ERROR_INVALID_COOKIE_VALUE},
+		{Cookie{Name: "n", Value: "semi;colon"}, ERROR_INVALID_COOKIE_VALUE},
+		{Cookie{Name: "n", Value: strings.Repeat("a", 4096)}, ERROR_COOKIE_TOO_LARGE},
+		{Cookie{Name: "n", Path: "relative"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "n", Domain: "exa mple.com"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "n", SameSite: SameSiteNone}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "n", SameSite: "Sometimes", Secure: true}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "n", Partitioned: true}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "__Secure-n"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "__Host-n", Secure: true, Path: "/", Domain: "example.com"}, ERROR_INVALID_COOKIE_ATTRIBUTE},
+		{Cookie{Name: "__Host-n", Secure: true, Path: "/"}, nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.err, tt.cookie.Valid(), tt.cookie.Name)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	// Test: FormatDigest renders a byte sequence member
+	h := NewDigestHash(DIGEST_SHA256)
+	h.Write([]byte("hello world"))
+	value := FormatDigest(DIGEST_SHA256, h.Sum(nil))
+	assert.Equal(t, "sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:", value)
+
+	// Test: ParseDigests reads several members
+	digests, err := ParseDigests(value + ", SHA-512=:AAAA:;param=1")
+	require.NoError(t, err)
+	assert.Equal(t, h.Sum(nil), digests["sha-256"])
+	assert.Equal(t, []byte{0, 0, 0}, digests["sha-512"])
+
+	// Test: values that aren't byte sequences are malformed
+	_, err = ParseDigests("sha-256=abc")
+	assert.Equal(t, ERROR_MALFORMED_DIGEST, err)
+	_, err = ParseDigests("sha-256=:not base64!:")
+	assert.Equal(t, ERROR_MALFORMED_DIGEST, err)
+
+	// Test: unsupported algorithms have no hash
+	assert.Nil(t, NewDigestHash("md5"))
+}
+
+func TestParseWantDigest(t *testing.T) {
+	// Test: supported algorithms come back by preference, zero weights dropped
+	algs, err := ParseWantDigest("sha-256=3, sha-512=10, md5=10, unixsum=0")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sha-512", "sha-256"}, algs)
+
+	algs, err = ParseWantDigest("sha-256=0")
+	require.NoError(t, err)
+	assert.Empty(t, algs)
+
+	// Test: weights must be integers from 0 to 10
+	_, err = ParseWantDigest("sha-256=11")
+	assert.Equal(t, ERROR_MALFORMED_DIGEST, err)
+	_, err = ParseWantDigest("sha-256")
+	assert.Equal(t, ERROR_MALFORMED_DIGEST, err)
+}
+
+func TestParseAuthorization(t *testing.T) {
+	// Test: token68 credentials
+	c, err := ParseAuthorization("Basic dXNlcjpwYXNz")
+	require.NoError(t, err)
+	assert.Equal(t, "Basic", c.Scheme)
+	assert.Equal(t, "dXNlcjpwYXNz", c.Token68)
+
+	c, err = ParseAuthorization("Bearer abc.def-ghi_jk==")
+	require.NoError(t, err)
+	assert.Equal(t, "abc.def-ghi_jk==", c.Token68)
+
+	// Test: auth-params, quoted or not
+	c, err = ParseAuthorization(`HMAC-SHA256 KeyId="k1", signature="a\"b=", alg=x`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"keyid": "k1", "signature": `a"b=`, "alg": "x"}, c.Params)
+
+	// Test: a bare scheme is allowed
+	c, err = ParseAuthorization("Negotiate")
+	require.NoError(t, err)
+	assert.Empty(t, c.Token68)
+
+	// Test: malformed values
+	for _, value := range []string{"", "Bad Scheme!", `X a="unterminated`, "X a=b c=d", `X a="1", a="2"`} {
+		_, err = ParseAuthorization(value)
+		assert.Equal(t, ERROR_MALFORMED_AUTHORIZATION, err, value)
+	}
+}
+
+func TestChallengeString(t *testing.T) {
+	// Test: params are quoted and escaped
+	c := Challenge{Scheme: "Bearer", Params: [][2]string{{"realm", `say "hi"`}, {"error", "invalid_token"}}}
+	assert.Equal(t, `Bearer realm="say \"hi\"", error="invalid_token"`, c.String())
+	assert.Equal(t, "Basic", Challenge{Scheme: "Basic"}.String())
+}
+
+type parseResult struct {
+	fields map[string][]string
+	n      int
+	done   bool
+	err    error
+}
+
+// parseSplit feeds data to Parse in two reads split at at, keeping the
+// unused bytes for the second call like a connection reader does.
+func parseSplit(data []byte, at int) parseResult {
+	h := NewHeaders()
+	n, done, err := h.Parse(data[:at])
+	if err != nil {
+		return parseResult{err: err}
+	}
+	if !done {
+		rest := append(append([]byte{}, data[n:at]...), data[at:]...)
+		var m int
+		m, done, err = h.Parse(rest)
+		if err != nil {
+			return parseResult{err: err}
+		}
+		n += m
+	}
+	return parseResult{fields: h.headers, n: n, done: done}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("Host: localhost:42069\r\nFooFoo: barbar\r\n\r\n"), uint16(10))
+	f.Add([]byte("Host: a\r\nHost: b\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\nbody"), uint16(20))
+	f.Add([]byte("       Host : localhost:42069       \r\n\r\n"), uint16(3))
+	f.Add([]byte("X: y\rTransfer-Encoding: chunked\r\n\r\n"), uint16(5))
+	f.Add([]byte("Transfer-Encoding:\r\n chunked\r\n\r\n"), uint16(19))
+	f.Add([]byte("X-Empty:\r\nX-Tab:\tvalue\t\r\n"), uint16(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, split uint16) {
+		whole := parseSplit(data, len(data))
+		// Test: the outcome doesn't depend on where the input was split
+		assert.Equal(t, whole, parseSplit(data, int(split)%(len(data)+1)))
+		if whole.err != nil {
+			return
+		}
+		assert.LessOrEqual(t, whole.n, len(data))
+		// Test: whatever got through is a clean field a lenient parser
+		// downstream can't read differently
+		for name, values := range whole.fields {
+			assert.True(t, isToken(name), name)
+			assert.Equal(t, strings.ToLower(name), name)
+			for _, v := range values {
+				assert.False(t, strings.ContainsAny(v, "\r\n\x00"), v)
+				assert.Equal(t, strings.TrimSpace(v), v)
+			}
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// methods we label as themselves, anything else becomes OTHER so clients
+// can't blow up the number of series
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func methodLabel(req *request.Request) string {
+	method := req.OriginalMethod()
+	if !knownMethods[method] {
+		return "OTHER"
+	}
+	return method
+}
+
+// ErrorType names a parse error for the parse_errors_total type label.
+func ErrorType(err error) string {
+	switch {
+	case errors.Is(err, request.ERROR_MALFORMED_REQUEST_LINE):
+		return "malformed_request_line"
+	case errors.Is(err, request.ERROR_UNSUPPORTED_HTTP_VERSION):
+		return "unsupported_http_version"
+	case errors.Is(err, headers.ERROR_MALFORMED_FIELD_LINE):
+		return "malformed_field_line"
+	case errors.Is(err, headers.ERROR_MALFORMED_FIELD_NAME):
+		return "malformed_field_name"
+	case errors.Is(err, headers.ERROR_MALFORMED_FIELD_VALUE):
+		return "malformed_field_value"
+	case errors.Is(err, request.ERROR_INVALID_CONTENT_LENGTH):
+		return "invalid_content_length"
+	case errors.Is(err, request.ERROR_CONFLICTING_FRAMING):
+		return "conflicting_framing"
+	case errors.Is(err, request.ERROR_MALFORMED_TRANSFER_ENCODING):
+		return "malformed_transfer_encoding"
+	case errors.Is(err, request.ERROR_UNSUPPORTED_TRANSFER_CODING):
+		return "unsupported_transfer_coding"
+	case errors.Is(err, request.ERROR_MALFORMED_CHUNK):
+		return "malformed_chunk"
+	case errors.Is(err, request.ERROR_REQUEST_HEADER_TOO_LARGE):
+		return "header_too_large"
+	case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		return "body_too_large"
+	case errors.Is(err, request.ERROR_UNSUPPORTED_CONTENT_ENCODING):
+		return "unsupported_content_encoding"
+	case errors.Is(err, request.ERROR_MALFORMED_ENCODED_BODY):
+		return "malformed_encoded_body"
+	case errors.Is(err, request.ERROR_DECODED_BODY_TOO_LARGE):
+		return "decoded_body_too_large"
+	case errors.Is(err, headers.ERROR_MALFORMED_DIGEST):
+		return "malformed_digest"
+	case errors.Is(err, request.ERROR_DIGEST_MISMATCH):
+		return "digest_mismatch"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected_eof"
+	default:
+		return "other"
+	}
+}
+
+// HTTPMetrics is the standard set of server metrics. Request metrics come
+// from Middleware, connection and parse error metrics from the server
+// hooks returned by ServerOptions.
+type HTTPMetrics struct {
+	requests     *CounterVec
+	requestSize  *HistogramVec
+	responseSize *HistogramVec
+	duration     *HistogramVec
+	connections  *GaugeVec
+	parseErrors  *CounterVec
+	rejected     *CounterVec
+
+	// last reported state per connection, so gauges can move between states
+	connStates sync.Map
+}
+
+func NewHTTPMetrics(reg *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: reg.NewCounterVec("http_requests_total",
+			"Requests handled, by method, route and status.", "method", "route", "status"),
+		requestSize: reg.NewHistogramVec("http_request_size_bytes",
+			"Size of request bodies.", SIZE_BUCKETS, "method", "route"),
+		responseSize: reg.NewHistogramVec("http_response_size_bytes",
+			"Size of response bodies sent.", SIZE_BUCKETS, "method", "route"),
+		duration: reg.NewHistogramVec("http_request_duration_seconds",
+			"Time from the handler starting until the response was finished.", nil, "method", "route"),
+		connections: reg.NewGaugeVec("http_connections",
+			"Open connections, by state.", "state"),
+		parseErrors: reg.NewCounterVec("http_parse_errors_total",
+			"Requests that couldn't be parsed, by error type.", "type"),
+		rejected: reg.NewCounterVec("http_connections_rejected_total",
+			"Connections turned away by the connection limits, by reason.", "reason"),
+	}
+}
+
+// OTHER_ROUTE is the route label used when Middleware has no route func.
+const OTHER_ROUTE = "other"
+
+// Middleware records every request. route maps a request to its route
+// label and must return a bounded set of values, never the raw path, which
+// the client controls. With a nil route every request is labeled
+// OTHER_ROUTE.
+func (m *HTTPMetrics) Middleware(route func(req *request.Request) string) server.Middleware {
+	if route == nil {
+		route = func(req *request.Request) string { return OTHER_ROUTE }
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			start := time.Now()
+			method, path := methodLabel(req), route(req)
+			m.requestSize.With(method, path).Observe(float64(len(req.Body)))
+			w.OnFinish(func() {
+				m.requests.With(method, path, strconv.Itoa(int(w.Status()))).Inc()
+				m.responseSize.With(method, path).Observe(float64(w.ContentBytesWritten()))
+				m.duration.With(method, path).Observe(time.Since(start).Seconds())
+			})
+			return next(w, req)
+		}
+	}
+}
+
+// ConnState tracks the connections gauge, see server.WithConnStateHook.
+func (m *HTTPMetrics) ConnState(conn net.Conn, state server.ConnState) {
+	if prev, ok := m.connStates.Load(conn); ok {
+		m.connections.With(prev.(server.ConnState).String()).Dec()
+	}
+	switch state {
+	case server.StateHijacked, server.StateClosed:
+		m.connStates.Delete(conn)
+	default:
+		m.connStates.Store(conn, state)
+		m.connections.With(state.String()).Inc()
+	}
+}
+
+// ParseError counts a parse error, see server.WithParseErrorHook.
+func (m *HTTPMetrics) ParseError(err error) {
+	m.parseErrors.With(ErrorType(err)).Inc()
+}
+
+// RejectedConn counts a connection turned away, see
+// server.WithRejectedConnHook.
+func (m *HTTPMetrics) RejectedConn(conn net.Conn, reason error) {
+	label := "server_busy"
+	if reason == server.ERROR_TOO_MANY_CLIENT_CONNS {
+		label = "client_limit"
+	}
+	m.rejected.With(label).Inc()
+}
+
+// ServerOptions hooks m into the server's connection and parse events.
+func (m *HTTPMetrics) ServerOptions() []server.Option {
+	return []server.Option{
+		server.WithConnStateHook(m.ConnState),
+		server.WithParseErrorHook(m.ParseError),
+		server.WithRejectedConnHook(m.RejectedConn),
+	}
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func Handler(reg *Registry) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		var buf bytes.Buffer
+		if err := reg.Write(&buf); err != nil {
+			return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+		}
+		h := response.GetDefaultHeaders(buf.Len())
+		h.Replace("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := w.WriteStatusLine(response.StatusOK); err != nil {
+			return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+		}
+		if err := w.WriteHeaders(h); err != nil {
+			return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+		}
+		w.WriteBody(buf.Bytes())
+		return nil
+	}
+}
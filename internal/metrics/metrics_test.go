@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("jobs_total", "Jobs run.\nBy kind.", "kind")
+	gauge := reg.NewGaugeVec("queue_depth", "Jobs waiting.")
+	hist := reg.NewHistogramVec("job_seconds", "Job latency.", []float64{0.1, 1})
+
+	counter.With(`a"b`).Add(2)
+	counter.With("plain").Inc()
+	gauge.With().Set(3)
+	gauge.With().Dec()
+	hist.With().Observe(0.05)
+	hist.With().Observe(0.5)
+	hist.With().Observe(5)
+
+	// Test: the text format with escaping, sorted series and cumulative buckets
+	var buf bytes.Buffer
+	require.NoError(t, reg.Write(&buf))
+	assert.Equal(t, `# HELP jobs_total Jobs run.\nBy kind.
+# TYPE jobs_total counter
+jobs_total{kind="a\"b"} 2
+jobs_total{kind="plain"} 1
+# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth 2
+# HELP job_seconds Job latency.
+# TYPE job_seconds histogram
+job_seconds_bucket{le="0.1"} 1
+job_seconds_bucket{le="1"} 2
+job_seconds_bucket{le="+Inf"} 3
+job_seconds_sum 5.55
+job_seconds_count 3
+`, buf.String())
+
+	// Test: label values must match the labels
+	assert.Panics(t, func() { counter.With("a", "b") })
+	assert.Panics(t, func() { counter.With("a").Add(-1) })
+}
+
+func serve(t *testing.T, handler server.Handler, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, handler(w, req))
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := NewRegistry()
+	m := NewHTTPMetrics(reg)
+	handler := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteToResponse([]byte("hello"))
+		return nil
+	}
+	hello := m.Middleware(func(req *request.Request) string {
+		if req.Path() == "/greet" {
+			return "/greet"
+		}
+		return OTHER_ROUTE
+	})(handler)
+
+	serve(t, hello, "POST /greet?x=1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc")
+	serve(t, hello, "BREW /greet HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	serve(t, hello, "GET /random-1234 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	serve(t, m.Middleware(nil)(handler), "GET /random-5678 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	streaming := m.Middleware(func(req *request.Request) string { return "/stream" })(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody([]byte("abc"))
+		w.Flush()
+		w.WriteBody([]byte("de"))
+		return nil
+	})
+	serve(t, streaming, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	m.ParseError(request.ERROR_MALFORMED_REQUEST_LINE)
+	m.ParseError(headers.ERROR_MALFORMED_FIELD_NAME)
+	m.ParseError(headers.ERROR_MALFORMED_FIELD_NAME)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	m.ConnState(a, server.StateNew)
+	m.ConnState(a, server.StateActive)
+	m.ConnState(b, server.StateNew)
+	m.ConnState(b, server.StateActive)
+	m.ConnState(b, server.StateIdle)
+	m.RejectedConn(a, server.ERROR_SERVER_BUSY)
+	m.RejectedConn(a, server.ERROR_TOO_MANY_CLIENT_CONNS)
+	m.RejectedConn(a, server.ERROR_TOO_MANY_CLIENT_CONNS)
+
+	// Test: /metrics exposes requests, sizes, connections and parse errors
+	out := serve(t, Handler(reg), "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",route="/greet",status="200"} 1`)
+	assert.Contains(t, out, `http_requests_total{method="OTHER",route="/greet",status="200"} 1`)
+
+	// Test: unknown paths, or any path without a route func, share one label
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 2`)
+	assert.NotContains(t, out, "random")
+
+	assert.Contains(t, out, `http_request_size_bytes_sum{method="POST",route="/greet"} 3`)
+	assert.Contains(t, out, `http_response_size_bytes_sum{method="POST",route="/greet"} 5`)
+	// Test: chunked responses count their content, not the framing
+	assert.Contains(t, out, `http_response_size_bytes_sum{method="GET",route="/stream"} 5`)
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="POST",route="/greet"} 1`)
+	assert.Contains(t, out, `http_connections{state="active"} 1`)
+	assert.Contains(t, out, `http_connections{state="idle"} 1`)
+	assert.Contains(t, out, `http_connections{state="new"} 0`)
+	assert.Contains(t, out, `http_parse_errors_total{type="malformed_field_name"} 2`)
+	assert.Contains(t, out, `http_parse_errors_total{type="malformed_request_line"} 1`)
+	assert.Contains(t, out, `http_connections_rejected_total{reason="server_busy"} 1`)
+	assert.Contains(t, out, `http_connections_rejected_total{reason="client_limit"} 2`)
+
+	// Test: closed connections leave the gauges
+	m.ConnState(a, server.StateClosed)
+	m.ConnState(b, server.StateHijacked)
+	out = serve(t, Handler(reg), "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, `http_connections{state="active"} 0`)
+	assert.Contains(t, out, `http_connections{state="idle"} 0`)
+}
@@ -0,0 +1,339 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ERROR_LABEL_COUNT = fmt.Errorf("wrong number of label values")
+
+// DEFAULT_BUCKETS suit latencies in seconds
+var DEFAULT_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// SIZE_BUCKETS suit body sizes in bytes
+var SIZE_BUCKETS = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000}
+
+// collector is anything the registry can render in the text exposition
+// format.
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds every metric served by Handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write renders every metric in the Prometheus text format, version 0.0.4.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// formatLabels renders {a="1",b="2"}, with extra appended last (used for
+// a histogram's le label).
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// vec is the label handling shared by every metric type. Children are
+// keyed by their label values joined with a byte that can't be typed.
+type vec[T any] struct {
+	mu       sync.Mutex
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(ERROR_LABEL_COUNT)
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	child, ok := v.children[key]
+	if !ok {
+		child = v.newChild()
+		v.children[key] = child
+		v.values[key] = slices.Clone(values)
+	}
+	return child
+}
+
+// each visits the children in label order so output is stable.
+func (v *vec[T]) each(fn func(values []string, child *T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+		values[i] = v.values[k]
+	}
+	v.mu.Unlock()
+	for i := range keys {
+		fn(values[i], children[i])
+	}
+}
+
+func (v *vec[T]) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, helpEscaper.Replace(v.help), v.name, v.kind)
+	return err
+}
+
+func newVec[T any](name, help, kind string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		name:     name,
+		help:     help,
+		kind:     kind,
+		labels:   labels,
+		children: map[string]*T{},
+		values:   map[string][]string{},
+		newChild: newChild,
+	}
+}
+
+// Counter only goes up.
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add panics on negative values, counters can't go down.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(c)
+	return c
+}
+
+// With returns the counter for the given label values, in label order.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values...)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.header(w); err != nil {
+		return err
+	}
+	var err error
+	c.each(func(values []string, child *Counter) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, values), formatFloat(child.Value()))
+		}
+	})
+	return err
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.with(values...)
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	if err := g.header(w); err != nil {
+		return err
+	}
+	var err error
+	g.each(func(values []string, child *Gauge) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, values), formatFloat(child.Value()))
+		}
+	})
+	return err
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// buckets are stored non-cumulative and summed up when written
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.buckets) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+	bounds []float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, which
+// must be sorted. nil uses DEFAULT_BUCKETS. The +Inf bucket is implied.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+	bounds := slices.Clone(buckets)
+	h := &HistogramVec{bounds: bounds}
+	h.vec = newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+	})
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.header(w); err != nil {
+		return err
+	}
+	var err error
+	h.each(func(values []string, child *Histogram) {
+		child.mu.Lock()
+		buckets := slices.Clone(child.buckets)
+		count, sum := child.count, child.sum
+		child.mu.Unlock()
+
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += buckets[i]
+			if err == nil {
+				_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(bound)), cumulative)
+			}
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+				h.name, formatLabels(h.labels, values, "le", "+Inf"), count,
+				h.name, formatLabels(h.labels, values), formatFloat(sum),
+				h.name, formatLabels(h.labels, values), count)
+		}
+	})
+	return err
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_DIAL_TIMEOUT = 10 * time.Second
+
+var ERROR_INVALID_AUTHORITY = fmt.Errorf("CONNECT target must be host:port")
+var ERROR_DESTINATION_NOT_ALLOWED = fmt.Errorf("destination not allowed")
+
+type ConnectOptions struct {
+	// AllowedHosts lists hosts that may be tunnelled to. Entries are exact
+	// names or "*.example.com" suffix patterns, and "*" allows any host.
+	// Empty allows none.
+	AllowedHosts []string
+	// AllowedPorts lists destination ports. Empty allows only 443.
+	AllowedPorts []int
+	// AllowPrivate lets tunnels reach loopback, private and link-local
+	// addresses. Off, a name on the allowlist that resolves to one of them
+	// is refused, so DNS can't point the proxy at internal services.
+	AllowPrivate bool
+	DialTimeout  time.Duration
+	// Dial replaces net.DialTimeout, mainly for tests.
+	Dial func(network, address string, timeout time.Duration) (net.Conn, error)
+	// LookupIP replaces net.DefaultResolver.LookupIP, mainly for tests.
+	LookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+func (o ConnectOptions) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range o.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (o ConnectOptions) portAllowed(port int) bool {
+	if len(o.AllowedPorts) == 0 {
+		return port == 443
+	}
+	return slices.Contains(o.AllowedPorts, port)
+}
+
+func (o ConnectOptions) ipAllowed(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	return o.AllowPrivate || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// resolve returns the address to dial for host. The address is picked and
+// checked here and dialled as is, so a second lookup can't swap it.
+func (o ConnectOptions) resolve(host string) (net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), o.DialTimeout)
+		defer cancel()
+		var err error
+		if ips, err = o.LookupIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if o.ipAllowed(ip) {
+			return ip, nil
+		}
+	}
+	return nil, ERROR_DESTINATION_NOT_ALLOWED
+}
+
+// parseAuthority splits an authority-form request target (RFC 9112
+// section 3.2.3) into host and port.
+func parseAuthority(target string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", 0, ERROR_INVALID_AUTHORITY
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, ERROR_INVALID_AUTHORITY
+	}
+	return host, port, nil
+}
+
+func handlerError(status response.StatusCode, message string) *server.HandlerError {
+	return &server.HandlerError{StatusCode: status, Message: message}
+}
+
+// ConnectHandler turns the server into a forward proxy for CONNECT
+// requests. Every other method goes to next, or gets a 405 when next is nil.
+func ConnectHandler(opts ConnectOptions, next server.Handler) server.Handler {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	if opts.Dial == nil {
+		opts.Dial = net.DialTimeout
+	}
+	if opts.LookupIP == nil {
+		opts.LookupIP = net.DefaultResolver.LookupIP
+	}
+
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		if req.RequestLine.Method != "CONNECT" {
+			if next == nil {
+				return handlerError(response.StatusMethodNotAllowed, "only CONNECT is supported")
+			}
+			return next(w, req)
+		}
+
+		host, port, err := parseAuthority(req.RequestLine.RequestTarget)
+		if err != nil {
+			return handlerError(response.StatusBadRequest, err.Error())
+		}
+		if !opts.hostAllowed(host) || !opts.portAllowed(port) {
+			return handlerError(response.StatusForbidden, ERROR_DESTINATION_NOT_ALLOWED.Error())
+		}
+		ip, err := opts.resolve(host)
+		if err == ERROR_DESTINATION_NOT_ALLOWED {
+			return handlerError(response.StatusForbidden, err.Error())
+		}
+		if err != nil {
+			return handlerError(response.StatusBadGateway, "could not resolve destination")
+		}
+
+		target, err := opts.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), opts.DialTimeout)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, os.ErrDeadlineExceeded) {
+				return handlerError(response.StatusGatewayTimeout, "timed out connecting to destination")
+			}
+			return handlerError(response.StatusBadGateway, "could not connect to destination")
+		}
+
+		client, buffered, err := w.Hijack()
+		if err != nil {
+			target.Close()
+			return handlerError(response.StatusInternalServerError, err.Error())
+		}
+		// written by hand, the Writer only knows the canonical reason phrase
+		if _, err := client.Write([]byte(response.HTTP_VERSION + " 200 Connection Established\r\n\r\n")); err != nil {
+			client.Close()
+			target.Close()
+			return nil
+		}
+		if len(buffered) > 0 {
+			if _, err := target.Write(buffered); err != nil {
+				client.Close()
+				target.Close()
+				return nil
+			}
+		}
+
+		Splice(client, target)
+		return nil
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies bytes both ways between a and b until both directions are
+// done, half-closing each side as its peer finishes, then closes both.
+func Splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startEchoServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveOne runs handler for a single connection the way the server does and
+// returns the client end.
+func serveOne(t *testing.T, handler server.Handler) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		reader := request.NewConnReader(conn, request.Options{})
+		w := response.NewConnWriter(conn, reader.Buffered)
+		req, err := reader.ReadRequest()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if herr := handler(w, req); herr != nil {
+			w.WriteStatusLine(herr.StatusCode)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		}
+		if !w.Hijacked() {
+			w.Finish()
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestConnectTunnel(t *testing.T) {
+	port := startEchoServer(t)
+	conn := serveOne(t, ConnectHandler(ConnectOptions{
+		AllowedHosts: []string{"127.0.0.1"},
+		AllowedPorts: []int{port},
+		AllowPrivate: true,
+	}, nil))
+
+	// the first tunnelled bytes ride along with the CONNECT request
+	target := "127.0.0.1:" + strconv.Itoa(port)
+	_, err := conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nearly "))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	blank, _ := br.ReadString('\n')
+	assert.Equal(t, "\r\n", blank)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, len("early ping"))
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early ping", string(buf))
+
+	// half-closing our side ends the tunnel cleanly
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func connectStatus(t *testing.T, opts ConnectOptions, next server.Handler, requestLine string) string {
+	conn := serveOne(t, ConnectHandler(opts, next))
+	_, err := conn.Write([]byte(requestLine + "\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(status)
+}
+
+func TestConnectRejected(t *testing.T) {
+	port := startEchoServer(t)
+	target := "127.0.0.1:" + strconv.Itoa(port)
+
+	// Test: port not on the allowlist (default is 443 only)
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, ConnectOptions{}, nil, "CONNECT "+target+" HTTP/1.1"))
+
+	// Test: host not on the allowlist
+	opts := ConnectOptions{AllowedHosts: []string{"*.example.com"}, AllowedPorts: []int{port}}
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, opts, nil, "CONNECT "+target+" HTTP/1.1"))
+	assert.True(t, opts.hostAllowed("api.example.com"))
+
+	// Test: target is not authority-form
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", connectStatus(t, ConnectOptions{}, nil, "CONNECT /path HTTP/1.1"))
+
+	// Test: nothing listening
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	opts = ConnectOptions{AllowedHosts: []string{"127.0.0.1"}, AllowedPorts: []int{closedPort}, AllowPrivate: true}
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", connectStatus(t, opts, nil, "CONNECT 127.0.0.1:"+strconv.Itoa(closedPort)+" HTTP/1.1"))
+
+	// Test: other methods fall through
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed", connectStatus(t, ConnectOptions{}, nil, "GET / HTTP/1.1"))
+	next := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteToResponse(nil)
+		return nil
+	}
+	assert.Equal(t, "HTTP/1.1 200 OK", connectStatus(t, ConnectOptions{}, next, "GET / HTTP/1.1"))
+
+	// Test: no allowlist means no tunnels at all
+	opts = ConnectOptions{AllowedPorts: []int{port}, AllowPrivate: true}
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, opts, nil, "CONNECT "+target+" HTTP/1.1"))
+
+	// Test: internal addresses are refused unless AllowPrivate is set
+	opts = ConnectOptions{AllowedHosts: []string{"*"}, AllowedPorts: []int{port}}
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, opts, nil, "CONNECT "+target+" HTTP/1.1"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, opts, nil, "CONNECT [::1]:"+strconv.Itoa(port)+" HTTP/1.1"))
+}
+
+func TestConnectResolvesOnce(t *testing.T) {
+	dialled := make(chan string, 1)
+	lookups := map[string][]net.IP{
+		"metadata.example.com": {net.ParseIP("169.254.169.254")},
+		"mixed.example.com":    {net.ParseIP("10.0.0.1"), net.ParseIP("93.184.216.34")},
+	}
+	opts := ConnectOptions{
+		AllowedHosts: []string{"*.example.com"},
+		LookupIP: func(ctx context.Context, network, host string) ([]net.IP, error) {
+			return lookups[host], nil
+		},
+		Dial: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			dialled <- address
+			return nil, fmt.Errorf("not dialling in tests")
+		},
+	}
+
+	// Test: an allowed name resolving to an internal address is refused
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", connectStatus(t, opts, nil, "CONNECT metadata.example.com:443 HTTP/1.1"))
+	assert.Empty(t, dialled)
+
+	// Test: the address that passed the check is the one dialled
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", connectStatus(t, opts, nil, "CONNECT mixed.example.com:443 HTTP/1.1"))
+	assert.Equal(t, "93.184.216.34:443", <-dialled)
+}
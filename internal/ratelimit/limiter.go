@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+var ERROR_INVALID_RATE = fmt.Errorf("ratelimit: rate must be positive")
+var ERROR_INVALID_BURST = fmt.Errorf("ratelimit: burst must be at least 1")
+
+// Result is a limiter's decision for one request.
+type Result struct {
+	Allowed bool
+	// Limit is the request quota, Remaining what is left of it after this
+	// request.
+	Limit     int
+	Remaining int
+	// Reset is how long until the quota is fully available again.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client should wait.
+	RetryAfter time.Duration
+	// Policy describes the quota for the RateLimit-Policy header.
+	Policy string
+}
+
+// Limiter decides whether the client identified by key may go ahead.
+type Limiter interface {
+	Allow(key string) (Result, error)
+}
+
+// TokenBucket lets a client burst up to Burst requests, refilling at Rate
+// requests per second.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+	store Store
+	now   func() time.Time
+}
+
+// NewTokenBucket panics if rate isn't positive or burst is below 1, which
+// would leave the bucket unable to refill or ever hold a token.
+func NewTokenBucket(rate float64, burst int, store Store) *TokenBucket {
+	if !(rate > 0) || math.IsInf(rate, 1) {
+		panic(ERROR_INVALID_RATE)
+	}
+	if burst < 1 {
+		panic(ERROR_INVALID_BURST)
+	}
+	return &TokenBucket{Rate: rate, Burst: burst, store: store, now: time.Now}
+}
+
+func (tb *TokenBucket) Allow(key string) (Result, error) {
+	now := tb.now()
+	burst := float64(tb.Burst)
+	// an idle key is just a full bucket, so it may be forgotten once it
+	// would have refilled
+	refill := time.Duration(burst / tb.Rate * float64(time.Second))
+	res := Result{Limit: tb.Burst, Policy: policy(tb.Burst, refill)}
+
+	err := tb.store.Update(key, refill, func(s *State) *State {
+		tokens := burst
+		if s != nil {
+			elapsed := max(now.Sub(s.Updated).Seconds(), 0)
+			tokens = min(burst, s.Tokens+elapsed*tb.Rate)
+		}
+		if tokens >= 1 {
+			tokens--
+			res.Allowed = true
+		} else {
+			res.RetryAfter = time.Duration((1 - tokens) / tb.Rate * float64(time.Second))
+		}
+		res.Remaining = int(math.Floor(tokens))
+		res.Reset = time.Duration((burst - tokens) / tb.Rate * float64(time.Second))
+		return &State{Tokens: tokens, Updated: now}
+	})
+	return res, err
+}
+
+// SlidingWindow allows Limit requests per Window. It approximates a true
+// sliding log by weighting the previous fixed window's count by how much
+// of it still overlaps the sliding window, which needs only two counters
+// per key.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+	store  Store
+	now    func() time.Time
+}
+
+func NewSlidingWindow(limit int, window time.Duration, store Store) *SlidingWindow {
+	return &SlidingWindow{Limit: limit, Window: window, store: store, now: time.Now}
+}
+
+func (sw *SlidingWindow) Allow(key string) (Result, error) {
+	now := sw.now()
+	limit := float64(sw.Limit)
+	window := sw.Window.Seconds()
+	res := Result{Limit: sw.Limit, Policy: policy(sw.Limit, sw.Window)}
+
+	err := sw.store.Update(key, 2*sw.Window, func(s *State) *State {
+		start := now.Truncate(sw.Window)
+		next := State{WindowStart: start}
+		if s != nil {
+			switch {
+			case s.WindowStart.Equal(start):
+				next.Count, next.PrevCount = s.Count, s.PrevCount
+			case s.WindowStart.Equal(start.Add(-sw.Window)):
+				next.PrevCount = s.Count
+			}
+		}
+		elapsed := now.Sub(start).Seconds()
+		weight := 1 - elapsed/window
+		used := float64(next.PrevCount)*weight + float64(next.Count)
+
+		if used+1 <= limit {
+			next.Count++
+			used++
+			res.Allowed = true
+		} else {
+			res.RetryAfter = sw.retryAfter(next, elapsed)
+		}
+		res.Remaining = max(int(math.Floor(limit-used)), 0)
+		switch {
+		case next.Count > 0:
+			// requests made now keep counting through the next window
+			res.Reset = time.Duration((2*window - elapsed) * float64(time.Second))
+		case next.PrevCount > 0:
+			res.Reset = time.Duration((window - elapsed) * float64(time.Second))
+		}
+		return &next
+	})
+	return res, err
+}
+
+// retryAfter works out when the weighted count drops low enough for one
+// more request.
+func (sw *SlidingWindow) retryAfter(s State, elapsed float64) time.Duration {
+	limit := float64(sw.Limit)
+	window := sw.Window.Seconds()
+	var wait float64
+	if float64(s.Count) <= limit-1 && s.PrevCount > 0 {
+		// the previous window's share has to fade enough
+		wait = window*(1-(limit-1-float64(s.Count))/float64(s.PrevCount)) - elapsed
+	} else {
+		// this window is full: wait for it to become the previous one and
+		// fade in turn
+		wait = window - elapsed
+		if s.Count > 0 {
+			wait += max(window*(1-(limit-1)/float64(s.Count)), 0)
+		}
+	}
+	return time.Duration(max(wait, 0) * float64(time.Second))
+}
+
+func policy(limit int, window time.Duration) string {
+	return strconv.Itoa(limit) + ";w=" + strconv.Itoa(int(math.Ceil(window.Seconds())))
+}
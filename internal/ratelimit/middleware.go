@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// KeyFunc picks the bucket a request counts against. An empty key lets
+// the request through unlimited.
+type KeyFunc func(req *request.Request) string
+
+// KeyByIP limits each client address separately.
+func KeyByIP() KeyFunc {
+	return func(req *request.Request) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		return "ip:" + host
+	}
+}
+
+// KeyByHeader limits each value of a header such as an API key. The client
+// picks that value, so a made up one would get a fresh bucket every time:
+// valid must accept only values that are known, or be nil when an earlier
+// middleware, such as auth, already rejected requests with a bad value.
+// Requests without an accepted value fall back to their client address, so
+// leaving the header out or rotating it isn't a way around the limit.
+func KeyByHeader(name string, valid func(value string) bool) KeyFunc {
+	byIP := KeyByIP()
+	return func(req *request.Request) string {
+		value, ok := req.Headers.Get(name)
+		if ok && value != "" && (valid == nil || valid(value)) {
+			return "header:" + value
+		}
+		return byIP(req)
+	}
+}
+
+type Options struct {
+	Limiter Limiter
+	// Key defaults to KeyByIP
+	Key KeyFunc
+}
+
+// whole seconds, rounded up so clients never come back too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func setHeaders(h *headers.Headers, res Result) {
+	h.Replace("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Replace("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Replace("RateLimit-Reset", ceilSeconds(res.Reset))
+	if res.Policy != "" {
+		h.Replace("RateLimit-Policy", res.Policy)
+	}
+}
+
+// Middleware answers 429 Too Many Requests once a client runs out of
+// quota, and tells every client where it stands through the RateLimit-*
+// headers. If the store fails the request is let through rather than
+// turning a limiter outage into a full outage.
+func Middleware(opts Options) server.Middleware {
+	if opts.Key == nil {
+		opts.Key = KeyByIP()
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			key := opts.Key(req)
+			if key == "" {
+				return next(w, req)
+			}
+			res, err := opts.Limiter.Allow(key)
+			if err != nil {
+				slog.Warn("rate limiter unavailable", "error", err)
+				return next(w, req)
+			}
+
+			if !res.Allowed {
+				message := "rate limit exceeded, retry in " + ceilSeconds(res.RetryAfter) + "s"
+				h := response.GetDefaultHeaders(len(message))
+				setHeaders(h, res)
+				h.Replace("Retry-After", ceilSeconds(res.RetryAfter))
+				if err := w.WriteStatusLine(response.StatusTooManyRequests); err != nil {
+					return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+				}
+				if err := w.WriteHeaders(h); err != nil {
+					return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+				}
+				w.WriteBody([]byte(message))
+				return nil
+			}
+
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				setHeaders(h, res)
+			})
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newClock() *clock {
+	return &clock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := newClock()
+	st := NewMemoryStore(0)
+	tb := NewTokenBucket(1, 3, st)
+	tb.now = c.now
+
+	// Test: a fresh key can burst
+	for i := 2; i >= 0; i-- {
+		res, err := tb.Allow("a")
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+		assert.Equal(t, 3, res.Limit)
+	}
+
+	// Test: the empty bucket rejects with the time until the next token
+	res, err := tb.Allow("a")
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+	assert.Equal(t, "3;w=3", res.Policy)
+
+	// Test: keys are independent
+	res, _ = tb.Allow("b")
+	assert.True(t, res.Allowed)
+
+	// Test: tokens refill at the rate, never past the burst
+	c.advance(1500 * time.Millisecond)
+	res, _ = tb.Allow("a")
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	c.advance(time.Hour)
+	res, _ = tb.Allow("a")
+	assert.Equal(t, 2, res.Remaining)
+
+	// Test: a bucket that could never refill or hold a token is refused
+	assert.PanicsWithValue(t, ERROR_INVALID_RATE, func() { NewTokenBucket(0, 3, st) })
+	assert.PanicsWithValue(t, ERROR_INVALID_RATE, func() { NewTokenBucket(math.NaN(), 3, st) })
+	assert.PanicsWithValue(t, ERROR_INVALID_BURST, func() { NewTokenBucket(1, 0, st) })
+}
+
+func TestSlidingWindow(t *testing.T) {
+	c := newClock()
+	sw := NewSlidingWindow(4, time.Minute, NewMemoryStore(0))
+	sw.now = c.now
+
+	// Test: up to the limit within one window
+	for i := 3; i >= 0; i-- {
+		res, err := sw.Allow("a")
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res, _ := sw.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, "4;w=60", res.Policy)
+	assert.Equal(t, 75*time.Second, res.RetryAfter) // until 4*0.75 + 1 fits
+
+	// Test: the previous window still counts, weighted by its overlap
+	c.advance(90 * time.Second) // half way into the next window
+	res, _ = sw.Allow("a")
+	assert.True(t, res.Allowed) // 4*0.5 + 1 = 3
+	res, _ = sw.Allow("a")
+	assert.True(t, res.Allowed) // 4*0.5 + 2 = 4
+	assert.Equal(t, 0, res.Remaining)
+	res, _ = sw.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 15*time.Second, res.RetryAfter) // weight has to drop to 1/4
+
+	// Test: after waiting RetryAfter the request goes through
+	c.advance(res.RetryAfter)
+	res, _ = sw.Allow("a")
+	assert.True(t, res.Allowed)
+
+	// Test: a window left idle for long enough is forgotten
+	c.advance(5 * time.Minute)
+	res, _ = sw.Allow("a")
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 3, res.Remaining)
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	st := NewMemoryStore(0)
+	update := func(key string, ttl time.Duration) {
+		st.Update(key, ttl, func(s *State) *State { return &State{Count: 1} })
+	}
+	update("short", time.Millisecond)
+	update("long", time.Hour)
+	assert.Equal(t, 2, st.Len())
+
+	// Test: the sweep drops only expired keys
+	st.evict(time.Now().Add(time.Minute))
+	assert.Equal(t, 1, st.Len())
+
+	// Test: expired state is not handed back
+	update("gone", -time.Second)
+	st.Update("gone", time.Hour, func(s *State) *State {
+		assert.Nil(t, s)
+		return nil
+	})
+	assert.Equal(t, 1, st.Len())
+
+	// Test: the background sweep stops on Close
+	swept := NewMemoryStore(time.Millisecond)
+	swept.Update("k", time.Nanosecond, func(s *State) *State { return &State{} })
+	assert.Eventually(t, func() bool { return swept.Len() == 0 }, time.Second, time.Millisecond)
+	swept.Close()
+}
+
+type failingStore struct{}
+
+func (failingStore) Update(string, time.Duration, func(*State) *State) error {
+	return fmt.Errorf("store down")
+}
+
+func hello(w *response.Writer, req *request.Request) *server.HandlerError {
+	w.WriteToResponse([]byte("hello"))
+	return nil
+}
+
+func run(t *testing.T, opts Options, addr, extra string) string {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = addr
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, Middleware(opts)(hello)(w, req))
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	c := newClock()
+	tb := NewTokenBucket(0.5, 2, NewMemoryStore(0))
+	tb.now = c.now
+	opts := Options{Limiter: tb}
+
+	// Test: allowed responses carry the quota headers
+	out := run(t, opts, "10.0.0.1:1000", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "ratelimit-limit: 2\r\n")
+	assert.Contains(t, out, "ratelimit-remaining: 1\r\n")
+	assert.Contains(t, out, "ratelimit-reset: 2\r\n")
+	assert.Contains(t, out, "ratelimit-policy: 2;w=4\r\n")
+
+	// Test: the same IP on another port shares the quota, then gets 429
+	run(t, opts, "10.0.0.1:2000", "")
+	out = run(t, opts, "10.0.0.1:3000", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 429 Too Many Requests\r\n"))
+	assert.Contains(t, out, "retry-after: 2\r\n")
+	assert.Contains(t, out, "ratelimit-remaining: 0\r\n")
+	assert.NotContains(t, out, "hello")
+
+	// Test: another IP is unaffected
+	out = run(t, opts, "10.0.0.2:1000", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: keying by header, falling back to the IP
+	opts.Key = KeyByHeader("X-Api-Key", func(value string) bool { return value == "k1" })
+	run(t, opts, "10.0.0.3:1000", "X-Api-Key: k1\r\n")
+	run(t, opts, "10.0.0.4:1000", "X-Api-Key: k1\r\n")
+	out = run(t, opts, "10.0.0.5:1000", "X-Api-Key: k1\r\n")
+	assert.Contains(t, out, " 429 ")
+	out = run(t, opts, "10.0.0.1:1000", "")
+	assert.Contains(t, out, " 429 ")
+
+	// Test: values the validator rejects count against the IP, so rotating
+	// them doesn't reset the limit
+	run(t, opts, "10.0.0.6:1000", "X-Api-Key: made-up-1\r\n")
+	run(t, opts, "10.0.0.6:1000", "X-Api-Key: made-up-2\r\n")
+	out = run(t, opts, "10.0.0.6:1000", "X-Api-Key: made-up-3\r\n")
+	assert.Contains(t, out, " 429 ")
+
+	// Test: an empty key is not limited
+	opts.Key = func(req *request.Request) string { return "" }
+	out = run(t, opts, "10.0.0.1:1000", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, out, "ratelimit-")
+
+	// Test: a failing store lets requests through
+	out = run(t, Options{Limiter: NewTokenBucket(1, 1, failingStore{})}, "10.0.0.1:1000", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
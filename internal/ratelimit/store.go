@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// State is what the algorithms keep per key. External stores persist it
+// however they like, it only needs to round-trip.
+type State struct {
+	// token bucket: tokens left as of Updated
+	Tokens  float64
+	Updated time.Time
+
+	// sliding window: requests counted in the window starting at
+	// WindowStart and in the one before it
+	WindowStart time.Time
+	Count       int
+	PrevCount   int
+}
+
+// Store holds limiter state, in process or in something shared between
+// several servers.
+type Store interface {
+	// Update replaces key's state with what fn returns and keeps it for
+	// ttl. fn gets nil for unknown or expired keys. Updates of the same key
+	// must not interleave.
+	Update(key string, ttl time.Duration, fn func(s *State) *State) error
+}
+
+type memoryEntry struct {
+	state     State
+	expiresAt time.Time
+}
+
+// MemoryStore keeps state in process memory. Keys nobody has used for
+// their ttl are dropped on access and by a background sweep every
+// interval until Close is called.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	stop    chan struct{}
+}
+
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	st := &MemoryStore{
+		entries: map[string]memoryEntry{},
+		stop:    make(chan struct{}),
+	}
+	if interval > 0 {
+		go st.sweep(interval)
+	}
+	return st
+}
+
+func (st *MemoryStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.stop:
+			return
+		case now := <-ticker.C:
+			st.evict(now)
+		}
+	}
+}
+
+func (st *MemoryStore) evict(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for key, e := range st.entries {
+		if now.After(e.expiresAt) {
+			delete(st.entries, key)
+		}
+	}
+}
+
+func (st *MemoryStore) Close() {
+	close(st.stop)
+}
+
+func (st *MemoryStore) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.entries)
+}
+
+func (st *MemoryStore) Update(key string, ttl time.Duration, fn func(s *State) *State) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var current *State
+	if e, ok := st.entries[key]; ok && !time.Now().After(e.expiresAt) {
+		current = &e.state
+	}
+	next := fn(current)
+	if next == nil {
+		delete(st.entries, key)
+		return nil
+	}
+	st.entries[key] = memoryEntry{state: *next, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
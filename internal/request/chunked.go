@@ -0,0 +1,131 @@
+package request
+
+import (
+	"build-http-protocol/internal/headers"
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+var ERROR_MALFORMED_CHUNK = fmt.Errorf("malformed chunked body")
+
+// longest chunk-size line, extensions included, we are willing to buffer
+const MAX_CHUNK_LINE = 4096
+
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailers
+	chunkDone
+)
+
+// chunkedDecoder undoes the chunked transfer coding from RFC 9112 section
+// 7.1 as bytes arrive. It is strict about every delimiter, as each
+// leniency is a way to make it disagree with another parser about where
+// the body ends.
+type chunkedDecoder struct {
+	state     chunkState
+	remaining int
+	trailers  *headers.Headers
+	// trailer section bytes so far, bounded like the header section
+	trailerBytes int
+}
+
+func isHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F'
+}
+
+// parseChunkSize reads a chunk-size line without its CRLF. Extensions are
+// allowed but ignored.
+func parseChunkSize(line []byte) (int, error) {
+	size, ext, _ := bytes.Cut(line, []byte(";"))
+	// 15 hex digits can't overflow an int64
+	if len(size) == 0 || len(size) > 15 {
+		return 0, ERROR_MALFORMED_CHUNK
+	}
+	for _, ch := range size {
+		if !isHex(ch) {
+			return 0, ERROR_MALFORMED_CHUNK
+		}
+	}
+	for _, ch := range ext {
+		if ch < ' ' && ch != '\t' || ch == 0x7f {
+			return 0, ERROR_MALFORMED_CHUNK
+		}
+	}
+	n, err := strconv.ParseInt(string(size), 16, 64)
+	if err != nil {
+		return 0, ERROR_MALFORMED_CHUNK
+	}
+	return int(n), nil
+}
+
+func (d *chunkedDecoder) done() bool {
+	return d.state == chunkDone
+}
+
+// parse decodes as much of data as it can. It returns the body bytes
+// decoded and how much of data was used.
+func (d *chunkedDecoder) parse(data []byte) ([]byte, int, error) {
+	body := []byte{}
+	read := 0
+	for {
+		rest := data[read:]
+		switch d.state {
+		case chunkSize:
+			idx := bytes.Index(rest, CRLF)
+			// without a CRLF yet, the last byte may still be its CR
+			if idx > MAX_CHUNK_LINE || idx == -1 && len(rest) > MAX_CHUNK_LINE+1 {
+				return nil, 0, ERROR_MALFORMED_CHUNK
+			}
+			if idx == -1 {
+				return body, read, nil
+			}
+			size, err := parseChunkSize(rest[:idx])
+			if err != nil {
+				return nil, 0, err
+			}
+			read += idx + len(CRLF)
+			if size == 0 {
+				d.trailers = headers.NewHeaders()
+				d.state = chunkTrailers
+			} else {
+				d.remaining = size
+				d.state = chunkData
+			}
+		case chunkData:
+			n := min(d.remaining, len(rest))
+			body = append(body, rest[:n]...)
+			read += n
+			d.remaining -= n
+			if d.remaining > 0 {
+				return body, read, nil
+			}
+			d.state = chunkDataEnd
+		case chunkDataEnd:
+			if len(rest) < len(CRLF) {
+				return body, read, nil
+			}
+			if !bytes.HasPrefix(rest, CRLF) {
+				return nil, 0, ERROR_MALFORMED_CHUNK
+			}
+			read += len(CRLF)
+			d.state = chunkSize
+		case chunkTrailers:
+			n, done, err := parseFields(d.trailers, rest, &d.trailerBytes)
+			if err != nil {
+				return nil, 0, err
+			}
+			read += n
+			if !done {
+				return body, read, nil
+			}
+			d.state = chunkDone
+		case chunkDone:
+			return body, read, nil
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package request
+
+import (
+	"build-http-protocol/internal/headers"
+	"crypto/subtle"
+	"fmt"
+)
+
+var ERROR_DIGEST_MISMATCH = fmt.Errorf("body does not match its digest")
+
+// verifyDigests checks the body against any Content-Digest or Repr-Digest
+// the client sent. Both cover the body as it came off the wire, so this
+// has to run before Content-Encoding is undone. Algorithms we don't know
+// are skipped, as RFC 9530 allows.
+func (r *Request) verifyDigests() error {
+	for _, field := range []string{headers.CONTENT_DIGEST, headers.REPR_DIGEST} {
+		value, ok := r.Headers.Get(field)
+		if !ok {
+			continue
+		}
+		digests, err := headers.ParseDigests(value)
+		if err != nil {
+			return err
+		}
+		for alg, want := range digests {
+			h := headers.NewDigestHash(alg)
+			if h == nil {
+				continue
+			}
+			h.Write([]byte(r.Body))
+			if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+				return ERROR_DIGEST_MISMATCH
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ERROR_UNSUPPORTED_CONTENT_ENCODING = fmt.Errorf("unsupported content encoding")
+var ERROR_MALFORMED_ENCODED_BODY = fmt.Errorf("malformed encoded body")
+var ERROR_DECODED_BODY_TOO_LARGE = fmt.Errorf("decoded body too large")
+
+const DEFAULT_MAX_DECODED_BODY_SIZE = 10 << 20
+
+func newDecoder(coding string, r io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// "deflate" is meant to be zlib wrapped, but plenty of clients send
+		// raw deflate streams, so peek at the header before choosing.
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0 {
+			return zlib.NewReader(bytes.NewReader(data))
+		}
+		return flate.NewReader(bytes.NewReader(data)), nil
+	default:
+		return nil, ERROR_UNSUPPORTED_CONTENT_ENCODING
+	}
+}
+
+func parseCodings(value string) []string {
+	codings := []string{}
+	for _, c := range strings.Split(value, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" || c == "identity" {
+			continue
+		}
+		codings = append(codings, c)
+	}
+	return codings
+}
+
+// decodeBody undoes every coding listed in Content-Encoding, last applied
+// first, and caps the decoded size at maxSize so a tiny compressed body
+// can't expand into gigabytes in memory.
+func (r *Request) decodeBody(maxSize int) error {
+	value, ok := r.Headers.Get("content-encoding")
+	if !ok {
+		return nil
+	}
+	codings := parseCodings(value)
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_DECODED_BODY_SIZE
+	}
+
+	body := []byte(r.Body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		dec, err := newDecoder(codings[i], bytes.NewReader(body))
+		if err == ERROR_UNSUPPORTED_CONTENT_ENCODING {
+			return err
+		}
+		if err != nil {
+			return ERROR_MALFORMED_ENCODED_BODY
+		}
+
+		out, err := io.ReadAll(io.LimitReader(dec, int64(maxSize)+1))
+		if err != nil {
+			return ERROR_MALFORMED_ENCODED_BODY
+		}
+		if len(out) > maxSize {
+			return ERROR_DECODED_BODY_TOO_LARGE
+		}
+		body = out
+	}
+
+	r.Body = string(body)
+	r.Headers.Delete("content-encoding")
+	// the body now sits in memory, so a Content-Length describes it and
+	// the wire framing no longer applies
+	r.Headers.Delete("transfer-encoding")
+	r.Headers.Replace("content-length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,449 @@
+package request
+
+import (
+	"bufio"
+	"build-http-protocol/internal/headers"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var ERROR_NOT_MULTIPART = fmt.Errorf("request is not multipart/form-data")
+var ERROR_MALFORMED_MULTIPART = fmt.Errorf("malformed multipart body")
+var ERROR_TOO_MANY_PARTS = fmt.Errorf("too many multipart parts")
+var ERROR_PART_TOO_LARGE = fmt.Errorf("multipart part too large")
+var ERROR_FORM_VALUES_TOO_LARGE = fmt.Errorf("multipart form values too large")
+
+// DEFAULT_FORM_MAX_MEMORY stays below DEFAULT_MAX_BODY_SIZE, so large
+// uploads spill to disk instead of being copied whole.
+const (
+	DEFAULT_FORM_MAX_MEMORY    = 4 << 20
+	DEFAULT_FORM_MAX_PARTS     = 1000
+	DEFAULT_FORM_MAX_PART_SIZE = 10 << 20
+	MULTIPART_BUFFER_SIZE      = 4096
+)
+
+type FormOptions struct {
+	// MaxMemory is how many bytes are kept in memory across all parts.
+	// Files past it are written to temp files, values past it are an
+	// error.
+	MaxMemory   int64
+	MaxParts    int
+	MaxPartSize int64
+}
+
+func (o FormOptions) withDefaults() FormOptions {
+	if o.MaxMemory <= 0 {
+		o.MaxMemory = DEFAULT_FORM_MAX_MEMORY
+	}
+	if o.MaxParts <= 0 {
+		o.MaxParts = DEFAULT_FORM_MAX_PARTS
+	}
+	if o.MaxPartSize <= 0 {
+		o.MaxPartSize = DEFAULT_FORM_MAX_PART_SIZE
+	}
+	return o
+}
+
+type Part struct {
+	Headers  *headers.Headers
+	FormName string
+	FileName string
+	mr       *MultipartReader
+	size     int64
+	eof      bool
+}
+
+// Read streams the part's content, stopping at the next delimiter.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	mr := p.mr
+	// a full buffer always holds more than the delimiter, so whatever
+	// can't be the start of one is safe to hand out
+	peek, err := mr.r.Peek(mr.r.Size())
+	n := len(peek) - len(mr.nlDelimiter) + 1
+	if idx := bytes.Index(peek, mr.nlDelimiter); idx == 0 {
+		mr.r.Discard(len(mr.nlDelimiter))
+		p.eof = true
+		return 0, io.EOF
+	} else if idx > 0 {
+		n = idx
+	} else if n <= 0 {
+		if err == io.EOF {
+			return 0, ERROR_MALFORMED_MULTIPART
+		}
+		return 0, err
+	}
+
+	n = copy(b, peek[:n])
+	mr.r.Discard(n)
+	if p.size += int64(n); p.size > mr.opts.MaxPartSize {
+		return 0, ERROR_PART_TOO_LARGE
+	}
+	return n, nil
+}
+
+// MultipartReader reads a multipart/form-data body part by part without
+// holding more than one buffer of it.
+type MultipartReader struct {
+	r           *bufio.Reader
+	delimiter   []byte
+	nlDelimiter []byte
+	started     bool
+	done        bool
+	parts       int
+	current     *Part
+	opts        FormOptions
+}
+
+func NewMultipartReader(reader io.Reader, boundary string, opts FormOptions) *MultipartReader {
+	delimiter := []byte("--" + boundary)
+	return &MultipartReader{
+		r:           bufio.NewReaderSize(reader, MULTIPART_BUFFER_SIZE),
+		delimiter:   delimiter,
+		nlDelimiter: append([]byte("\r\n"), delimiter...),
+		opts:        opts.withDefaults(),
+	}
+}
+
+// skipPreamble discards everything up to the first delimiter, which has
+// to start a line.
+func (mr *MultipartReader) skipPreamble() error {
+	for {
+		start, err := mr.r.Peek(len(mr.delimiter))
+		if bytes.Equal(start, mr.delimiter) {
+			mr.r.Discard(len(mr.delimiter))
+			return nil
+		}
+		if err != nil {
+			return ERROR_MALFORMED_MULTIPART
+		}
+		for {
+			line, err := mr.r.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil || !bytes.HasSuffix(line, CRLF) {
+				return ERROR_MALFORMED_MULTIPART
+			}
+			break
+		}
+	}
+}
+
+func (mr *MultipartReader) readHeaders() (*headers.Headers, error) {
+	h := headers.NewHeaders()
+	size := 0
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		if err != nil {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		if size += len(line); size > MAX_BUFFER_SIZE {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		n, done, err := h.Parse(line)
+		if err != nil || n != len(line) {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		if done {
+			return h, nil
+		}
+	}
+}
+
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	if mr.current != nil {
+		// whatever the caller left unread of the last part
+		if _, err := io.Copy(io.Discard, mr.current); err != nil {
+			return nil, err
+		}
+		mr.current = nil
+	} else if !mr.started {
+		if err := mr.skipPreamble(); err != nil {
+			return nil, err
+		}
+		mr.started = true
+	}
+
+	if next, _ := mr.r.Peek(2); bytes.Equal(next, []byte("--")) {
+		mr.done = true
+		return nil, io.EOF
+	}
+	for {
+		ch, err := mr.r.ReadByte()
+		if err != nil {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		if ch == ' ' || ch == '\t' {
+			continue
+		}
+		if ch != '\r' {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		if ch, err = mr.r.ReadByte(); err != nil || ch != '\n' {
+			return nil, ERROR_MALFORMED_MULTIPART
+		}
+		break
+	}
+
+	mr.parts++
+	if mr.parts > mr.opts.MaxParts {
+		return nil, ERROR_TOO_MANY_PARTS
+	}
+
+	h, err := mr.readHeaders()
+	if err != nil {
+		return nil, err
+	}
+	part := &Part{Headers: h, mr: mr}
+	if cd, ok := h.Get("content-disposition"); ok {
+		disposition, params, err := mime.ParseMediaType(cd)
+		if err == nil && disposition == "form-data" {
+			part.FormName = params["name"]
+			part.FileName = params["filename"]
+		}
+	}
+	mr.current = part
+	return part, nil
+}
+
+type FileHeader struct {
+	Filename string
+	Headers  *headers.Headers
+	Size     int64
+	content  []byte
+	tmpFile  string
+}
+
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpFile != "" {
+		return os.Open(fh.tmpFile)
+	}
+	return io.NopCloser(strings.NewReader(string(fh.content))), nil
+}
+
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes any temp files created for spilled uploads.
+func (f *MultipartForm) RemoveAll() error {
+	var err error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpFile == "" {
+				continue
+			}
+			if e := os.Remove(fh.tmpFile); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func (r *Request) Query() url.Values {
+	_, rawQuery, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	values, _ := url.ParseQuery(rawQuery)
+	return values
+}
+
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, ok := r.Headers.Get("content-type")
+	if !ok {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// ParseForm fills PostForm from an application/x-www-form-urlencoded body
+// and Form with the body values followed by the query string values.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	r.PostForm = url.Values{}
+	if mediaType, _ := r.mediaType(); mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(r.Body)
+		if err != nil {
+			return err
+		}
+		r.PostForm = values
+	}
+
+	r.Form = url.Values{}
+	for k, v := range r.PostForm {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	for k, v := range r.Query() {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	return nil
+}
+
+// MultipartReader reads the parts of a multipart/form-data body one at a
+// time, straight from the already read body without copying it.
+func (r *Request) MultipartReader(opts FormOptions) (*MultipartReader, error) {
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ERROR_NOT_MULTIPART
+	}
+	return NewMultipartReader(strings.NewReader(r.Body), params["boundary"], opts), nil
+}
+
+func (r *Request) ParseMultipartForm(opts FormOptions) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	opts = opts.withDefaults()
+	mr, err := r.MultipartReader(opts)
+	if err != nil {
+		return err
+	}
+
+	form := &MultipartForm{
+		Value: map[string][]string{},
+		File:  map[string][]*FileHeader{},
+	}
+	memoryLeft := opts.MaxMemory
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return err
+		}
+		if part.FormName == "" {
+			continue
+		}
+
+		if part.FileName == "" {
+			var buf bytes.Buffer
+			n, err := io.CopyN(&buf, part, memoryLeft+1)
+			if err != nil && err != io.EOF {
+				form.RemoveAll()
+				return err
+			}
+			if n > memoryLeft {
+				form.RemoveAll()
+				return ERROR_FORM_VALUES_TOO_LARGE
+			}
+			memoryLeft -= n
+			form.Value[part.FormName] = append(form.Value[part.FormName], buf.String())
+			continue
+		}
+
+		fh := &FileHeader{
+			Filename: part.FileName,
+			Headers:  part.Headers,
+		}
+		// read one byte past what fits to know whether the file does
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, part, memoryLeft+1)
+		if err != nil && err != io.EOF {
+			form.RemoveAll()
+			return err
+		}
+		if n <= memoryLeft {
+			fh.content = buf.Bytes()
+			fh.Size = n
+			memoryLeft -= n
+		} else if err := spill(fh, &buf, part); err != nil {
+			form.RemoveAll()
+			return err
+		}
+		form.File[part.FormName] = append(form.File[part.FormName], fh)
+	}
+
+	// body values take precedence over the query string, as in ParseForm
+	for k, v := range form.Value {
+		r.Form[k] = append(append([]string{}, v...), r.Form[k]...)
+		r.PostForm[k] = append(r.PostForm[k], v...)
+	}
+	r.MultipartForm = form
+	if r.forms != nil {
+		*r.forms = append(*r.forms, form)
+	}
+	return nil
+}
+
+// RemoveMultipartFiles deletes the temp files of every multipart form
+// parsed from this request, copies made with WithContext included. The
+// server calls it once the handler returns.
+func (r *Request) RemoveMultipartFiles() error {
+	if r.forms == nil {
+		return nil
+	}
+	var err error
+	for _, form := range *r.forms {
+		if e := form.RemoveAll(); e != nil && err == nil {
+			err = e
+		}
+	}
+	*r.forms = nil
+	return err
+}
+
+// spill writes a file part that doesn't fit in memory to a temp file: the
+// bytes already read, then the rest of the part.
+func spill(fh *FileHeader, head io.Reader, part io.Reader) error {
+	f, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return err
+	}
+	fh.tmpFile = f.Name()
+	fh.Size, err = io.Copy(f, io.MultiReader(head, part))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.tmpFile)
+		fh.tmpFile = ""
+	}
+	return err
+}
+
+// FormValue returns the first value for key from the body or query string,
+// parsing the form on first use.
+func (r *Request) FormValue(key string) (string, error) {
+	if r.Form == nil {
+		var err error
+		if mediaType, _ := r.mediaType(); mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(FormOptions{})
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return r.Form.Get(key), nil
+}
@@ -0,0 +1,87 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("invalid content-length")
+var ERROR_CONFLICTING_FRAMING = fmt.Errorf("both transfer-encoding and content-length")
+var ERROR_MALFORMED_TRANSFER_ENCODING = fmt.Errorf("malformed transfer-encoding")
+var ERROR_UNSUPPORTED_TRANSFER_CODING = fmt.Errorf("unsupported transfer coding")
+
+// enough for any body we would accept, short enough to never overflow int
+const MAX_CONTENT_LENGTH_DIGITS = 18
+
+// parseContentLength accepts only plain decimal digits: no sign, no
+// spaces, no list of values.
+func parseContentLength(value string) (int, error) {
+	if value == "" || len(value) > MAX_CONTENT_LENGTH_DIGITS {
+		return 0, ERROR_INVALID_CONTENT_LENGTH
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, ERROR_INVALID_CONTENT_LENGTH
+		}
+	}
+	return strconv.Atoi(value)
+}
+
+// bodyFraming works out how the body is delimited, following RFC 9112
+// section 6. Anything ambiguous is refused rather than guessed at: a proxy
+// in front of us may guess differently, and then the two disagree on
+// where this request ends and the next one starts.
+func (r *Request) bodyFraming() error {
+	te := r.Headers.Values("transfer-encoding")
+	cl := r.Headers.Values("content-length")
+
+	if len(te) > 0 {
+		// HTTP/1.0 has no chunked coding, a 1.0 message with one is faulty
+		if r.RequestLine.HttpVersion == "1.0" {
+			return ERROR_MALFORMED_TRANSFER_ENCODING
+		}
+		if len(cl) > 0 {
+			return ERROR_CONFLICTING_FRAMING
+		}
+		codings := []string{}
+		for _, value := range te {
+			for _, coding := range strings.Split(value, ",") {
+				// empty list elements are allowed and mean nothing
+				if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" {
+					codings = append(codings, coding)
+				}
+			}
+		}
+		// chunked is the only thing that delimits the body, so it must come
+		// last and only once
+		last := len(codings) - 1
+		if last < 0 || codings[last] != "chunked" {
+			return ERROR_MALFORMED_TRANSFER_ENCODING
+		}
+		for _, coding := range codings[:last] {
+			if coding == "chunked" {
+				return ERROR_MALFORMED_TRANSFER_ENCODING
+			}
+			return ERROR_UNSUPPORTED_TRANSFER_CODING
+		}
+		r.chunked = &chunkedDecoder{}
+		return nil
+	}
+
+	switch len(cl) {
+	case 0:
+		r.contentLength = 0
+	case 1:
+		n, err := parseContentLength(cl[0])
+		if err != nil {
+			return err
+		}
+		r.contentLength = n
+	default:
+		// even identical copies mean someone on the way added or
+		// duplicated a field, so the framing can't be trusted
+		return ERROR_INVALID_CONTENT_LENGTH
+	}
+	return nil
+}
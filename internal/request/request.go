@@ -3,9 +3,12 @@ package request
 import (
 	"build-http-protocol/internal/headers"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"strconv"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type parseState string
@@ -28,22 +31,93 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     *headers.Headers
 	Body        string
-	state       parseState
+	// Trailers holds the trailer fields of a chunked body
+	Trailers *headers.Headers
+	// RemoteAddr is the client's address, filled in by the server
+	RemoteAddr string
+	state      parseState
+
+	// populated by ParseForm / ParseMultipartForm
+	Form          url.Values
+	PostForm      url.Values
+	MultipartForm *MultipartForm
+	// every form parsed, shared with copies of the request
+	forms *[]*MultipartForm
+
+	ctx context.Context
+	// set by AsGet, see OriginalMethod
+	originalMethod string
+
+	// how the body is framed, settled once the headers are in
+	contentLength int
+	chunked       *chunkedDecoder
+	headerBytes   int
+	maxBodySize   int
+
+	// when the first byte, the end of the headers and the end of the body
+	// were seen
+	startedAt time.Time
+	headersAt time.Time
+	doneAt    time.Time
+}
+
+// ParseTiming reports when the request's first bytes arrived, when its
+// headers were fully parsed and when its body was complete.
+func (r *Request) ParseTiming() (start, headersDone, bodyDone time.Time) {
+	return r.startedAt, r.headersAt, r.doneAt
 }
 
-func getInt(header *headers.Headers, key string, defaultValue int) int {
-	valStr, exists := header.Get(key)
+// AsGet returns a copy of a HEAD request dressed up as GET, so handlers
+// only have to know about GET. IsHead and OriginalMethod still report the
+// original method.
+func (r *Request) AsGet() *Request {
+	r2 := *r
+	r2.originalMethod = r.OriginalMethod()
+	r2.RequestLine.Method = "GET"
+	return &r2
+}
 
-	if !exists {
-		return defaultValue
+// OriginalMethod is the method the client sent, before AsGet rewrote it.
+// Logs, metrics and signatures should use it rather than the rewritten one.
+func (r *Request) OriginalMethod() string {
+	if r.originalMethod != "" {
+		return r.originalMethod
 	}
+	return r.RequestLine.Method
+}
 
-	value, err := strconv.Atoi(valStr)
-	if err != nil {
-		return defaultValue
+func (r *Request) IsHead() bool {
+	return r.OriginalMethod() == "HEAD"
+}
+
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
 	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r carrying ctx, for middleware that
+// needs to hand request scoped values down to the next handler.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+var ERROR_NO_COOKIE = fmt.Errorf("named cookie not present")
 
-	return value
+func (r *Request) Cookies() []*headers.Cookie {
+	return r.Headers.Cookies()
+}
+
+func (r *Request) Cookie(name string) (*headers.Cookie, error) {
+	for _, c := range r.Headers.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ERROR_NO_COOKIE
 }
 
 func (r *Request) done() bool {
@@ -59,6 +133,7 @@ func newRequest() *Request {
 		state:   StateInit,
 		Headers: headers.NewHeaders(),
 		Body:    "",
+		forms:   &[]*MultipartForm{},
 	}
 }
 
@@ -88,7 +163,7 @@ outer:
 			read += n
 			r.state = StateHeaders
 		case StateHeaders:
-			n, done, err := r.Headers.Parse(data[read:])
+			n, done, err := parseFields(r.Headers, data[read:], &r.headerBytes)
 			if err != nil {
 				return 0, err
 			}
@@ -99,21 +174,47 @@ outer:
 			}
 
 			if done {
+				if err := r.bodyFraming(); err != nil {
+					r.state = StateError
+					return 0, err
+				}
+				if r.contentLength > r.maxBodySize {
+					r.state = StateError
+					return 0, ERROR_BODY_TOO_LARGE
+				}
 				r.state = StateBody
 			}
 		case StateBody:
-			contentLength := getInt(r.Headers, "content-length", 0)
-			if contentLength == 0 {
+			if r.chunked != nil {
+				body, n, err := r.chunked.parse(data[read:])
+				if err != nil {
+					r.state = StateError
+					return 0, err
+				}
+				if len(r.Body)+len(body) > r.maxBodySize {
+					r.state = StateError
+					return 0, ERROR_BODY_TOO_LARGE
+				}
+				r.Body += string(body)
+				read += n
+				if r.chunked.done() {
+					r.Trailers = r.chunked.trailers
+					r.state = StateDone
+				}
+				break outer
+			}
+
+			if r.contentLength == 0 {
 				r.state = StateDone
 				break
 			}
 
-			bytesToRead := min(contentLength-len(r.Body), len(data[read:]))
+			bytesToRead := min(r.contentLength-len(r.Body), len(data[read:]))
 			r.Body += string(data[read : read+bytesToRead])
 
 			read += bytesToRead
 
-			if len(r.Body) == contentLength {
+			if len(r.Body) == r.contentLength {
 				r.state = StateDone
 			}
 			break outer
@@ -128,6 +229,53 @@ outer:
 	return read, nil
 }
 
+// parseFields parses a header or trailer section, counting its bytes in
+// used. Lines are consumed as they are parsed, so the buffer limit alone
+// doesn't bound a section. Only the bytes still allowed are looked at,
+// which makes the outcome the same however the bytes arrive.
+func parseFields(h *headers.Headers, data []byte, used *int) (int, bool, error) {
+	allowed := MAX_BUFFER_SIZE - *used
+	n, done, err := h.Parse(data[:min(len(data), allowed)])
+	if err != nil {
+		return 0, false, err
+	}
+	*used += n
+	if !done && len(data) >= allowed {
+		return 0, false, ERROR_REQUEST_HEADER_TOO_LARGE
+	}
+	return n, done, nil
+}
+
+// isMethod reports whether method is a token as RFC 9110 requires.
+func isMethod(method []byte) bool {
+	if len(method) == 0 {
+		return false
+	}
+	for _, ch := range method {
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' {
+			continue
+		}
+		if strings.IndexByte("!#$%&'*+-.^_`|~", ch) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isTarget rejects targets with control characters, which some parsers
+// treat as line or field delimiters.
+func isTarget(target []byte) bool {
+	if len(target) == 0 {
+		return false
+	}
+	for _, ch := range target {
+		if ch <= ' ' || ch == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(b, CRLF)
 	if idx == -1 {
@@ -143,7 +291,14 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	}
 
 	httpParts := bytes.Split(parts[2], []byte("/"))
-	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" || string(httpParts[1]) != "1.1" {
+	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" {
+		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+	if string(httpParts[1]) != "1.1" && string(httpParts[1]) != "1.0" {
+		return nil, 0, ERROR_UNSUPPORTED_HTTP_VERSION
+	}
+
+	if !isMethod(parts[0]) || !isTarget(parts[1]) {
 		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
@@ -156,23 +311,117 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	return rl, read, nil
 }
 
+type Options struct {
+	// DecodeBody transparently undoes gzip/deflate Content-Encoding on the
+	// request body once it has been read.
+	DecodeBody         bool
+	MaxDecodedBodySize int
+	// MaxBodySize bounds the body as sent, whatever its framing. Zero uses
+	// DEFAULT_MAX_BODY_SIZE.
+	MaxBodySize int
+	// VerifyDigests rejects requests whose body doesn't match the
+	// Content-Digest or Repr-Digest they carry.
+	VerifyDigests bool
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return RequestFromReaderWithOptions(reader, Options{})
+}
+
+func RequestFromReaderWithOptions(reader io.Reader, opts Options) (*Request, error) {
+	return NewConnReader(reader, opts).ReadRequest()
+}
+
+var ERROR_REQUEST_HEADER_TOO_LARGE = fmt.Errorf("request header too large")
+var ERROR_BODY_TOO_LARGE = fmt.Errorf("request body too large")
+
+const (
+	INITIAL_BUFFER_SIZE   = 1024
+	MAX_BUFFER_SIZE       = 64 * 1024
+	DEFAULT_MAX_BODY_SIZE = 10 << 20
+)
+
+// ConnReader reads requests off a connection. Bytes read past the end of a
+// request stay in its buffer instead of being thrown away, so they can be
+// handed to whoever takes over the connection next.
+type ConnReader struct {
+	reader io.Reader
+	opts   Options
+	buf    []byte
+	bufIdx int
+}
+
+func NewConnReader(reader io.Reader, opts Options) *ConnReader {
+	return &ConnReader{
+		reader: reader,
+		opts:   opts,
+		buf:    make([]byte, INITIAL_BUFFER_SIZE),
+	}
+}
+
+// Buffered returns the bytes read from the connection but not yet parsed.
+func (cr *ConnReader) Buffered() []byte {
+	return cr.buf[:cr.bufIdx]
+}
+
+func (cr *ConnReader) ReadRequest() (*Request, error) {
 	request := newRequest()
-	buf := make([]byte, 1024)
-	bufIdx := 0
-	for !request.done() && !request.error() {
-		n, err := reader.Read(buf[bufIdx:])
-		if err != nil {
-			return nil, err
+	request.maxBodySize = cr.opts.MaxBodySize
+	if request.maxBodySize <= 0 {
+		request.maxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+	var readErr error
+	for {
+		if request.startedAt.IsZero() && cr.bufIdx > 0 {
+			request.startedAt = time.Now()
 		}
-		bufIdx += n
-		readN, err := request.parse(buf[:bufIdx])
+		readN, err := request.parse(cr.buf[:cr.bufIdx])
 		if err != nil {
 			return nil, err
 		}
+		if request.headersAt.IsZero() && (request.state == StateBody || request.state == StateDone) {
+			request.headersAt = time.Now()
+		}
 		// why though? because it'll not read all the data available
-		copy(buf, buf[readN:bufIdx])
-		bufIdx -= readN
+		copy(cr.buf, cr.buf[readN:cr.bufIdx])
+		cr.bufIdx -= readN
+
+		if request.done() {
+			request.doneAt = time.Now()
+			break
+		}
+		if readErr == io.EOF && (request.state != StateInit || cr.bufIdx > 0) {
+			// the peer hung up in the middle of a request
+			return nil, io.ErrUnexpectedEOF
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		// a full buffer means a single line or the header block doesn't fit
+		if cr.bufIdx == len(cr.buf) {
+			if len(cr.buf) >= MAX_BUFFER_SIZE {
+				return nil, ERROR_REQUEST_HEADER_TOO_LARGE
+			}
+			buf := make([]byte, len(cr.buf)*2)
+			copy(buf, cr.buf[:cr.bufIdx])
+			cr.buf = buf
+		}
+
+		var n int
+		n, readErr = cr.reader.Read(cr.buf[cr.bufIdx:])
+		cr.bufIdx += n
+	}
+
+	if cr.opts.VerifyDigests {
+		if err := request.verifyDigests(); err != nil {
+			return nil, err
+		}
+	}
+	if cr.opts.DecodeBody {
+		if err := request.decodeBody(cr.opts.MaxDecodedBodySize); err != nil {
+			return nil, err
+		}
 	}
 	return request, nil
 }
@@ -1,7 +1,16 @@
 package request
 
 import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/response"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"fmt"
 	"io"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -131,3 +140,707 @@ func TestParseBody(t *testing.T) {
 	require.Error(t, err)
 
 }
+
+func gzipString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.String()
+}
+
+func encodedRequest(encoding, body string) string {
+	return "POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + body
+}
+
+func TestDecodeBody(t *testing.T) {
+	// Test: gzip body is decoded
+	reader := &chunkReader{
+		data:            encodedRequest("gzip", gzipString(t, "hello world!\n")),
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReaderWithOptions(reader, Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", r.Body)
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	val, _ := r.Headers.Get("content-length")
+	assert.Equal(t, "13", val)
+
+	// Test: deflate (zlib wrapped) body is decoded
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte("deflated"))
+	zw.Close()
+	r, err = RequestFromReaderWithOptions(strings.NewReader(encodedRequest("deflate", buf.String())), Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "deflated", r.Body)
+
+	// Test: a decoded chunked body is described by Content-Length alone
+	chunked := gzipString(t, "chunked")
+	r, err = RequestFromReaderWithOptions(strings.NewReader("POST /submit HTTP/1.1\r\nHost: localhost:42069\r\n"+
+		"Content-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		strconv.FormatInt(int64(len(chunked)), 16)+"\r\n"+chunked+"\r\n0\r\n\r\n"), Options{DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "chunked", r.Body)
+	_, ok = r.Headers.Get("transfer-encoding")
+	assert.False(t, ok)
+	val, _ = r.Headers.Get("content-length")
+	assert.Equal(t, "7", val)
+
+	// Test: body is left alone without the option
+	compressed := gzipString(t, "hello")
+	r, err = RequestFromReader(strings.NewReader(encodedRequest("gzip", compressed)))
+	require.NoError(t, err)
+	assert.Equal(t, compressed, r.Body)
+
+	// Test: unknown encoding
+	_, err = RequestFromReaderWithOptions(strings.NewReader(encodedRequest("br", "abc")), Options{DecodeBody: true})
+	assert.Equal(t, ERROR_UNSUPPORTED_CONTENT_ENCODING, err)
+
+	// Test: decoded body over the limit
+	bomb := gzipString(t, strings.Repeat("a", 4096))
+	_, err = RequestFromReaderWithOptions(strings.NewReader(encodedRequest("gzip", bomb)), Options{DecodeBody: true, MaxDecodedBodySize: 1024})
+	assert.Equal(t, ERROR_DECODED_BODY_TOO_LARGE, err)
+
+	// Test: corrupt gzip body
+	_, err = RequestFromReaderWithOptions(strings.NewReader(encodedRequest("gzip", "not gzip")), Options{DecodeBody: true})
+	assert.Equal(t, ERROR_MALFORMED_ENCODED_BODY, err)
+}
+
+func formRequest(contentType, body string) string {
+	return "POST /upload?source=query&name=fromquery HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + body
+}
+
+const multipartBody = "preamble\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"name\"\r\n" +
+	"\r\n" +
+	"gopher\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"notes.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\nline two\r\n" +
+	"--xyz--\r\n"
+
+func formValue(t *testing.T, r *Request, key string) string {
+	v, err := r.FormValue(key)
+	require.NoError(t, err)
+	return v
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: urlencoded body merged with query
+	r, err := RequestFromReader(strings.NewReader(formRequest("application/x-www-form-urlencoded", "name=frombody&x=1+2")))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "/upload", r.Path())
+	assert.Equal(t, "frombody", formValue(t, r, "name"))
+	assert.Equal(t, []string{"frombody", "fromquery"}, r.Form["name"])
+	assert.Equal(t, "1 2", r.PostForm.Get("x"))
+	assert.Equal(t, "query", formValue(t, r, "source"))
+	assert.Equal(t, "", r.PostForm.Get("source"))
+
+	// Test: multipart values and files
+	r, err = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseMultipartForm(FormOptions{}))
+	assert.Equal(t, "gopher", formValue(t, r, "name"))
+	assert.Equal(t, "query", formValue(t, r, "source"))
+	require.Len(t, r.MultipartForm.File["upload"], 1)
+	fh := r.MultipartForm.File["upload"][0]
+	assert.Equal(t, "notes.txt", fh.Filename)
+	assert.Equal(t, int64(18), fh.Size)
+	ct, _ := fh.Headers.Get("content-type")
+	assert.Equal(t, "text/plain", ct)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	data, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "line one\r\nline two", string(data))
+
+	// Test: files past MaxMemory spill to disk
+	r, err = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseMultipartForm(FormOptions{MaxMemory: 8}))
+	fh = r.MultipartForm.File["upload"][0]
+	assert.NotEmpty(t, fh.tmpFile)
+	f, err = fh.Open()
+	require.NoError(t, err)
+	data, _ = io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "line one\r\nline two", string(data))
+
+	// Test: RemoveMultipartFiles cleans up forms parsed on copies too
+	copied := r.WithContext(t.Context())
+	copied.MultipartForm = nil
+	require.NoError(t, copied.ParseMultipartForm(FormOptions{MaxMemory: 8}))
+	other := copied.MultipartForm.File["upload"][0].tmpFile
+	require.NoError(t, r.RemoveMultipartFiles())
+	for _, path := range []string{fh.tmpFile, other} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+
+	// Test: values count against MaxMemory too, and can't spill
+	r, err = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	require.NoError(t, err)
+	assert.Equal(t, ERROR_FORM_VALUES_TOO_LARGE, r.ParseMultipartForm(FormOptions{MaxMemory: 4}))
+
+	// Test: streaming parts
+	r, err = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	require.NoError(t, err)
+	mr, err := r.MultipartReader(FormOptions{})
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "name", part.FormName)
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", part.FileName)
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: limits
+	r, _ = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	assert.Equal(t, ERROR_TOO_MANY_PARTS, r.ParseMultipartForm(FormOptions{MaxParts: 1}))
+	r, _ = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", multipartBody)))
+	assert.Equal(t, ERROR_PART_TOO_LARGE, r.ParseMultipartForm(FormOptions{MaxPartSize: 10}))
+
+	// Test: missing closing delimiter
+	r, _ = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", "--xyz\r\n\r\nunterminated")))
+	assert.Equal(t, ERROR_MALFORMED_MULTIPART, r.ParseMultipartForm(FormOptions{}))
+
+	// Test: not multipart
+	r, _ = RequestFromReader(strings.NewReader(formRequest("text/plain", "hi")))
+	assert.Equal(t, ERROR_NOT_MULTIPART, r.ParseMultipartForm(FormOptions{}))
+
+	// Test: a file cut short is an error, not a truncated upload
+	r, _ = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz",
+		"--xyz\r\nContent-Disposition: form-data; name=\"f\"; filename=\"a\"\r\n\r\nno end")))
+	assert.Equal(t, ERROR_MALFORMED_MULTIPART, r.ParseMultipartForm(FormOptions{}))
+
+	// Test: FormValue reports parse errors
+	r, _ = RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", "--xyz\r\n\r\nunterminated")))
+	_, err = r.FormValue("name")
+	assert.Equal(t, ERROR_MALFORMED_MULTIPART, err)
+}
+
+func TestMultipartStreaming(t *testing.T) {
+	// Test: parts far larger than the read buffer stream through it, and
+	// only MaxMemory of a file is held before it spills to disk
+	big := strings.Repeat("0123456789abcdef", 4*MULTIPART_BUFFER_SIZE)
+	body := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"big.bin\"\r\n\r\n" +
+		big + "\r\n--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"small\"; filename=\"s.txt\"\r\n\r\n" +
+		"tiny\r\n--xyz--\r\n"
+	mr := NewMultipartReader(&chunkReader{data: body, numBytesPerRead: 7}, "xyz", FormOptions{})
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, big, string(data))
+	// Test: an unread part is skipped by NextPart
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "s.txt", part.FileName)
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	r, err := RequestFromReader(strings.NewReader(formRequest("multipart/form-data; boundary=xyz", body)))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseMultipartForm(FormOptions{MaxMemory: 1024}))
+	defer r.MultipartForm.RemoveAll()
+	fh := r.MultipartForm.File["upload"][0]
+	assert.NotEmpty(t, fh.tmpFile)
+	assert.Nil(t, fh.content)
+	assert.Equal(t, int64(len(big)), fh.Size)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	data, _ = io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, big, string(data))
+	// the small file still fits in what is left
+	assert.Empty(t, r.MultipartForm.File["small"][0].tmpFile)
+}
+
+func TestConnReaderBuffered(t *testing.T) {
+	// Test: bytes past the end of the request are kept
+	cr := NewConnReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\nleftover bytes"), Options{})
+	r, err := cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.RequestLine.RequestTarget)
+	assert.Equal(t, "leftover bytes", string(cr.Buffered()))
+
+	// Test: header lines longer than the initial buffer
+	long := strings.Repeat("a", 3000)
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Long: " + long + "\r\n\r\n"))
+	require.NoError(t, err)
+	val, _ := r.Headers.Get("x-long")
+	assert.Equal(t, long, val)
+
+	// Test: header lines longer than the max buffer
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", MAX_BUFFER_SIZE) + "\r\n\r\n"))
+	assert.Equal(t, ERROR_REQUEST_HEADER_TOO_LARGE, err)
+}
+
+func TestAsGet(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("HEAD /index.html HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.IsHead())
+
+	get := r.AsGet()
+	assert.Equal(t, "GET", get.RequestLine.Method)
+	assert.Equal(t, "/index.html", get.RequestLine.RequestTarget)
+	assert.True(t, get.IsHead())
+	assert.Equal(t, "HEAD", r.RequestLine.Method)
+
+	// Test: the original method survives AsGet and later copies
+	assert.Equal(t, "HEAD", r.OriginalMethod())
+	assert.Equal(t, "HEAD", get.OriginalMethod())
+	assert.Equal(t, "HEAD", get.AsGet().WithContext(t.Context()).OriginalMethod())
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.OriginalMethod())
+	assert.False(t, r.IsHead())
+}
+
+func digestRequest(field, value, body string) string {
+	return "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		field + ": " + value + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + body
+}
+
+func TestVerifyDigests(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello world"))
+	good := headers.FormatDigest(headers.DIGEST_SHA256, sum[:])
+
+	// Test: a matching Content-Digest is accepted
+	reader := &chunkReader{
+		data:            digestRequest("Content-Digest", good, "hello world"),
+		numBytesPerRead: 4,
+	}
+	r, err := RequestFromReaderWithOptions(reader, Options{VerifyDigests: true})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", r.Body)
+
+	// Test: a tampered body is rejected
+	_, err = RequestFromReaderWithOptions(strings.NewReader(digestRequest("Repr-Digest", good, "hello World")), Options{VerifyDigests: true})
+	assert.Equal(t, ERROR_DIGEST_MISMATCH, err)
+
+	// Test: unknown algorithms are ignored
+	_, err = RequestFromReaderWithOptions(strings.NewReader(digestRequest("Content-Digest", "md5=:AAAA:", "hello")), Options{VerifyDigests: true})
+	require.NoError(t, err)
+
+	// Test: a malformed field is rejected
+	_, err = RequestFromReaderWithOptions(strings.NewReader(digestRequest("Content-Digest", "sha-256=abc", "hello")), Options{VerifyDigests: true})
+	assert.Equal(t, headers.ERROR_MALFORMED_DIGEST, err)
+
+	// Test: the digest covers the encoded body, not the decoded one
+	compressed := gzipString(t, "hello")
+	sum = sha256.Sum256([]byte(compressed))
+	raw := "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Encoding: gzip\r\n" +
+		"Content-Digest: " + headers.FormatDigest(headers.DIGEST_SHA256, sum[:]) + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(compressed)) + "\r\n\r\n" + compressed
+	r, err = RequestFromReaderWithOptions(strings.NewReader(raw), Options{VerifyDigests: true, DecodeBody: true})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", r.Body)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: chunks are joined, read a byte at a time
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: Chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;name=\"value\"\r\n world!\r\n" +
+			"A\r\n0123456789\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!0123456789", r.Body)
+
+	// Test: trailers are kept apart from the headers
+	cr := NewConnReader(strings.NewReader("POST / HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"3\r\nabc\r\n"+
+		"0\r\n"+
+		"Content-Digest: sha-256=:AAAA:\r\n"+
+		"\r\n"+
+		"GET /next HTTP/1.1\r\n"), Options{})
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", r.Body)
+	digest, ok := r.Trailers.Get("content-digest")
+	assert.True(t, ok)
+	assert.Equal(t, "sha-256=:AAAA:", digest)
+	_, ok = r.Headers.Get("content-digest")
+	assert.False(t, ok)
+
+	// Test: the next pipelined request is left in the buffer
+	assert.Equal(t, "GET /next HTTP/1.1\r\n", string(cr.Buffered()))
+
+	// Test: a body cut short is an unexpected EOF
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Test: chunks adding up past MaxBodySize are refused, however they're split
+	opts := Options{MaxBodySize: 8}
+	_, err = RequestFromReaderWithOptions(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, opts)
+	assert.Equal(t, ERROR_BODY_TOO_LARGE, err)
+	r, err = RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nhell\r\n4\r\no wo\r\n0\r\n\r\n"), opts)
+	require.NoError(t, err)
+	assert.Equal(t, "hello wo", r.Body)
+
+	// Test: so are Content-Length bodies, before any of the body is read
+	_, err = RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n"), opts)
+	assert.Equal(t, ERROR_BODY_TOO_LARGE, err)
+	_, err = RequestFromReader(strings.NewReader(fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n", DEFAULT_MAX_BODY_SIZE+1)))
+	assert.Equal(t, ERROR_BODY_TOO_LARGE, err)
+}
+
+func TestContentLength(t *testing.T) {
+	// Test: surrounding whitespace is fine, it isn't part of the value
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length:   5 \r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", r.Body)
+
+	// Test: an explicit zero means no body
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: leading zeroes are still digits
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 003\r\n\r\nabc"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", r.Body)
+}
+
+// smugglingCorpus holds requests that parsers have historically disagreed
+// on. Each must be refused outright: accepting any of them means this
+// parser could see a different request boundary than a proxy in front of
+// it.
+var smugglingCorpus = []struct {
+	name string
+	raw  string
+	err  error
+}{
+	// CL.TE: the front end trusts Content-Length, we would trust chunked
+	{"CL.TE", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED", ERROR_CONFLICTING_FRAMING},
+	// TE.CL: the other way round
+	{"TE.CL", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n", ERROR_CONFLICTING_FRAMING},
+	{"TE.CL tab", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding:\tchunked\r\n\r\n5c\r\nGPOST / HTTP/1.1\r\n\r\n0\r\n\r\n", ERROR_CONFLICTING_FRAMING},
+	{"CL.TE after", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 6\r\n\r\n0\r\n\r\nG", ERROR_CONFLICTING_FRAMING},
+
+	// TE.TE: obfuscated Transfer-Encoding that one side ignores
+	{"TE.TE xchunked", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE chunk", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunk\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE quoted", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: \"chunked\"\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE second field", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE chunked twice", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE chunked not last", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE empty", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: ,\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE.TE space before colon", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_NAME},
+	{"TE.TE tab before colon", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_NAME},
+	{"TE.TE leading space", "POST / HTTP/1.1\r\nHost: x\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_NAME},
+	{"TE.TE line folding", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_LINE},
+	{"TE.TE bare LF", "POST / HTTP/1.1\r\nHost: x\r\nX: y\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_VALUE},
+	{"TE.TE bare CR", "POST / HTTP/1.1\r\nHost: x\r\nX: y\rTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_VALUE},
+	{"TE.TE NUL", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\x00\r\n\r\n0\r\n\r\n", headers.ERROR_MALFORMED_FIELD_VALUE},
+	{"TE in HTTP/1.0", "POST / HTTP/1.0\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ERROR_MALFORMED_TRANSFER_ENCODING},
+	{"TE gzip", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", ERROR_UNSUPPORTED_TRANSFER_CODING},
+
+	// CL.CL: lengths that parsers read differently
+	{"CL.CL conflicting", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL.CL duplicate", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL list", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\nhello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL plus sign", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\nhello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL negative", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL hex", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0x5\r\n\r\nhello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL exponent", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1e1\r\n\r\nhellohello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL inner space", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1 0\r\n\r\nhellohello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL empty", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: \r\n\r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL overflow", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 18446744073709551621\r\n\r\nhello", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL space before colon", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length : 5\r\n\r\nhello", headers.ERROR_MALFORMED_FIELD_NAME},
+
+	// chunk framing a lenient decoder would let slide
+	{"chunk size leading space", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n 5\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk size prefix", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk size negative", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n-5\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk size overflow", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000005\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk size bare LF", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk longer than size", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk data bare LF", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk extension CR", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5;a\rb\r\nhello\r\n0\r\n\r\n", ERROR_MALFORMED_CHUNK},
+	{"chunk size line too long", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5;" + strings.Repeat("a", MAX_CHUNK_LINE), ERROR_MALFORMED_CHUNK},
+
+	// request lines with characters other parsers split on
+	{"method not a token", "G(ET / HTTP/1.1\r\nHost: x\r\n\r\n", ERROR_MALFORMED_REQUEST_LINE},
+	{"target NUL", "GET /\x00admin HTTP/1.1\r\nHost: x\r\n\r\n", ERROR_MALFORMED_REQUEST_LINE},
+	{"target tab", "GET /\tadmin HTTP/1.1\r\nHost: x\r\n\r\n", ERROR_MALFORMED_REQUEST_LINE},
+}
+
+func TestSmugglingCorpus(t *testing.T) {
+	for _, c := range smugglingCorpus {
+		t.Run(c.name, func(t *testing.T) {
+			// Test: refused whether it arrives whole or byte by byte
+			for _, perRead := range []int{len(c.raw), 1} {
+				_, err := RequestFromReader(&chunkReader{data: c.raw, numBytesPerRead: perRead})
+				assert.Equal(t, c.err, err)
+			}
+		})
+	}
+}
+
+// parsed flattens the outcome of a parse so runs fed the same bytes in
+// different reads can be compared.
+type parsed struct {
+	line     RequestLine
+	headers  map[string]string
+	trailers map[string]string
+	body     string
+	err      error
+}
+
+func fields(h *headers.Headers) map[string]string {
+	if h == nil {
+		return nil
+	}
+	m := map[string]string{}
+	h.ForEach(func(n, v string) {
+		m[n] += v + "\n"
+	})
+	return m
+}
+
+// fuzzMaxBodySize is small enough for fuzzed inputs to run into it.
+const fuzzMaxBodySize = 64
+
+// checkLimits asserts what must hold after any parse, failed or not.
+func checkLimits(t *testing.T, cr *ConnReader, data []byte, r *Request) {
+	// Test: the buffer never grows past its limit, whatever the input
+	assert.LessOrEqual(t, len(cr.buf), MAX_BUFFER_SIZE)
+	assert.LessOrEqual(t, len(cr.Buffered()), MAX_BUFFER_SIZE)
+	if r != nil {
+		// Test: a body is never more than what was sent, nor than allowed
+		assert.LessOrEqual(t, len(r.Body), len(data))
+		assert.LessOrEqual(t, len(r.Body), fuzzMaxBodySize)
+	}
+}
+
+func parseWith(t *testing.T, data []byte, reader io.Reader) parsed {
+	cr := NewConnReader(reader, Options{MaxBodySize: fuzzMaxBodySize})
+	r, err := cr.ReadRequest()
+	checkLimits(t, cr, data, r)
+	if err != nil {
+		return parsed{err: err}
+	}
+	// pipelined requests behind the first must keep to the limits too
+	for {
+		next, err := cr.ReadRequest()
+		checkLimits(t, cr, data, next)
+		if err != nil {
+			break
+		}
+	}
+	return parsed{
+		line:     r.RequestLine,
+		headers:  fields(r.Headers),
+		trailers: fields(r.Trailers),
+		body:     r.Body,
+	}
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"), uint16(5))
+	f.Add([]byte("POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"), uint16(40))
+	f.Add([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;a=b\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n"), uint16(50))
+	for _, c := range smugglingCorpus {
+		f.Add([]byte(c.raw), uint16(len(c.raw)/2))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, split uint16) {
+		at := int(split) % (len(data) + 1)
+		whole := parseWith(t, data, bytes.NewReader(data))
+		// Test: where the reads split the input doesn't change the outcome
+		assert.Equal(t, whole, parseWith(t, data, io.MultiReader(bytes.NewReader(data[:at]), bytes.NewReader(data[at:]))))
+		assert.Equal(t, whole, parseWith(t, data, &chunkReader{data: string(data), numBytesPerRead: 1}))
+	})
+}
+
+type decoded struct {
+	body     string
+	read     int
+	done     bool
+	trailers map[string]string
+	err      error
+}
+
+// decode feeds data to a chunked decoder in reads of at most perRead
+// bytes, keeping what it didn't use like ConnReader does.
+func decode(data []byte, perRead int) decoded {
+	d := &chunkedDecoder{}
+	body := []byte{}
+	buf := []byte{}
+	read := 0
+	for pos := 0; pos < len(data) && !d.done(); {
+		end := min(pos+perRead, len(data))
+		buf = append(buf, data[pos:end]...)
+		pos = end
+		b, n, err := d.parse(buf)
+		if err != nil {
+			return decoded{err: err}
+		}
+		body = append(body, b...)
+		buf = buf[n:]
+		read += n
+	}
+	return decoded{body: string(body), read: read, done: d.done(), trailers: fields(d.trailers)}
+}
+
+func FuzzChunkedDecoder(f *testing.F) {
+	f.Add([]byte("5\r\nhello\r\n0\r\n\r\n"), uint16(3))
+	f.Add([]byte("7;name=\"value\"\r\n world!\r\nA\r\n0123456789\r\n0\r\n\r\n"), uint16(1))
+	f.Add([]byte("3\r\nabc\r\n0\r\nContent-Digest: sha-256=:AAAA:\r\n\r\nGET /next HTTP/1.1\r\n"), uint16(7))
+	f.Add([]byte("5\nhello\r\n0\r\n\r\n"), uint16(2))
+	f.Add([]byte("10000000000000005\r\nhello\r\n0\r\n\r\n"), uint16(4))
+
+	f.Fuzz(func(t *testing.T, data []byte, split uint16) {
+		whole := decode(data, len(data)+1)
+		// Test: the body, the bytes used and any error don't depend on reads
+		assert.Equal(t, whole, decode(data, int(split)%(len(data)+1)+1))
+		assert.Equal(t, whole, decode(data, 1))
+		// Test: never more body than input, never more input used than given
+		assert.LessOrEqual(t, len(whole.body), len(data))
+		assert.LessOrEqual(t, whole.read, len(data))
+	})
+}
+
+func FuzzChunkedRoundTrip(f *testing.F) {
+	f.Add([]byte("hello world!"), uint8(5))
+	f.Add([]byte(""), uint8(0))
+	f.Add([]byte("0\r\n\r\n"), uint8(1))
+	f.Add(bytes.Repeat([]byte("x"), 300), uint8(255))
+
+	f.Fuzz(func(t *testing.T, body []byte, size uint8) {
+		var out bytes.Buffer
+		w := response.NewWriter(&out)
+		require.NoError(t, w.DeclareTrailer("X-Checksum"))
+		require.NoError(t, w.WriteStatusLine(response.StatusOK))
+		require.NoError(t, w.WriteHeaders(response.GetDefaultHeaders(0)))
+		for rest := body; len(rest) > 0; {
+			n := min(int(size)+1, len(rest))
+			_, err := w.WriteChunkedBody(rest[:n])
+			require.NoError(t, err)
+			rest = rest[n:]
+		}
+		sum := sha256.Sum256(body)
+		require.NoError(t, w.SetTrailer("X-Checksum", fmt.Sprintf("%x", sum)))
+		require.NoError(t, w.Finish())
+
+		head, chunked, ok := bytes.Cut(out.Bytes(), []byte("\r\n\r\n"))
+		require.True(t, ok)
+		assert.Contains(t, string(head)+"\r\n", "\r\ntransfer-encoding: chunked\r\n")
+
+		// Test: what the writer encodes the decoder gives back unchanged
+		got := decode(chunked, len(chunked))
+		require.NoError(t, got.err)
+		assert.True(t, got.done)
+		assert.Equal(t, len(chunked), got.read)
+		assert.Equal(t, string(body), got.body)
+		assert.Equal(t, map[string]string{"x-checksum": fmt.Sprintf("%x\n", sum)}, got.trailers)
+	})
+}
+
+func isTchar(ch rune) bool {
+	return ch < 0x7f && ch > ' ' && !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", ch)
+}
+
+func FuzzHeadersRoundTrip(f *testing.F) {
+	f.Add("Host", "localhost:42069")
+	f.Add("X-Empty", "")
+	f.Add("Content-Digest", "sha-256=:AAAA:")
+	f.Add("Cache-Control", "no-cache,\tmax-age=0")
+	f.Add("X-Sum", "1\r\nX-Injected: 1")
+
+	f.Fuzz(func(t *testing.T, name, value string) {
+		valid := name != "" && strings.IndexFunc(name, func(ch rune) bool { return !isTchar(ch) }) == -1 &&
+			!strings.ContainsAny(value, "\r\n\x00")
+
+		// Test: a trailer is either refused or read back as exactly the
+		// field that was set, never as more fields
+		var out bytes.Buffer
+		w := response.NewWriter(&out)
+		require.NoError(t, w.WriteStatusLine(response.StatusOK))
+		require.NoError(t, w.WriteHeaders(response.GetDefaultHeaders(0)))
+		_, err := w.WriteChunkedBody([]byte("x"))
+		require.NoError(t, err)
+		err = w.SetTrailer(name, value)
+		if !valid {
+			assert.Equal(t, response.ERROR_INVALID_TRAILER, err)
+		}
+		require.NoError(t, w.Finish())
+		_, chunked, ok := bytes.Cut(out.Bytes(), []byte("\r\n\r\n"))
+		require.True(t, ok)
+		got := decode(chunked, len(chunked))
+		require.NoError(t, got.err)
+		assert.Equal(t, len(chunked), got.read)
+		if err == nil {
+			assert.Equal(t, map[string]string{strings.ToLower(name): strings.TrimSpace(value) + "\n"}, got.trailers)
+		} else {
+			assert.Empty(t, got.trailers)
+		}
+
+		// only what a handler may legitimately send round-trips
+		if !valid || strings.TrimSpace(value) != value {
+			t.Skip()
+		}
+		// a 204 has no framing fields, the writer drops these
+		if strings.EqualFold(name, "content-length") || strings.EqualFold(name, "transfer-encoding") {
+			t.Skip()
+		}
+
+		out.Reset()
+		w = response.NewWriter(&out)
+		h := headers.NewHeaders()
+		h.Set(name, value)
+		require.NoError(t, w.WriteStatusLine(response.StatusNoContent))
+		require.NoError(t, w.WriteHeaders(h))
+		require.NoError(t, w.Finish())
+
+		_, block, ok := bytes.Cut(out.Bytes(), CRLF)
+		require.True(t, ok)
+		// Test: what the writer sends the parser reads back as the same field
+		parsed := headers.NewHeaders()
+		n, done, err := parsed.Parse(block)
+		require.NoError(t, err)
+		assert.True(t, done)
+		assert.Equal(t, len(block), n)
+		parsedValue, ok := parsed.Get(name)
+		assert.True(t, ok)
+		assert.Equal(t, value, parsedValue)
+	})
+}
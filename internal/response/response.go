@@ -1,22 +1,65 @@
 package response
 
 import (
+	"bufio"
 	"build-http-protocol/internal/headers"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 )
 
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusNotModified                 StatusCode = 304
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusRequestEntityTooLarge       StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusNoContent:                   "No Content",
+	StatusNotModified:                 "Not Modified",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusRequestEntityTooLarge:       "Content Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+}
+
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
 const HTTP_VERSION = "HTTP/1.1"
 
+var CRLF = []byte("\r\n")
+
 type Response struct {
 }
 
@@ -26,28 +69,411 @@ const (
 	StateStatusCode WriterState = "StatusCode"
 	StateHeaders    WriterState = "Headers"
 	StateBody       WriterState = "Body"
+	StateHijacked   WriterState = "Hijacked"
+)
+
+var ERROR_HIJACK_NOT_SUPPORTED = fmt.Errorf("underlying writer is not a net.Conn")
+var ERROR_HIJACKED = fmt.Errorf("connection has been hijacked")
+var ERROR_HIJACK_NOT_ALLOWED = fmt.Errorf("connection cannot be hijacked for this request")
+var ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("invalid Content-Length header")
+var ERROR_BODY_EXCEEDS_CONTENT_LENGTH = fmt.Errorf("body is longer than the declared Content-Length")
+var ERROR_BODY_SHORTER_THAN_CONTENT_LENGTH = fmt.Errorf("body is shorter than the declared Content-Length")
+
+// framing is how the end of the response body is signalled to the client.
+type framing int
+
+const (
+	// headers are held back and the body buffered until we know its size
+	framingUndecided framing = iota
+	framingLength
+	// the writer wraps every body write in a chunk
+	framingChunked
+	// the handler declared Transfer-Encoding and frames the body itself
+	framingRaw
+	// HTTP/1.0 without a length: the body ends when the connection closes
+	framingClose
+	// the status code doesn't allow a body
+	framingNone
 )
 
+const DEFAULT_WRITE_BUFFER_SIZE = 4096
+
 type Writer struct {
 	writerState WriterState
 	conn        io.Writer
+	// everything goes through out so the status line, headers and small
+	// body writes leave in as few syscalls as possible
+	out           *bufio.Writer
+	cookies       []*headers.Cookie
+	hooks         []func(h *headers.Headers)
+	bodyObservers []func(p []byte)
+	finishHooks   []func()
+	stopHooks     []func()
+	buffered      func() []byte
+
+	status         StatusCode
+	requestVersion string
+	header         *headers.Headers
+	framing        framing
+	pending        []byte
+	remaining      int64
+	chunkedDone    bool
+	mustClose      bool
+	omitBody       bool
+	hijackRefused  bool
+	aborted        bool
+	unobserved     bool
+	bodyBytes      int64
+	contentBytes   int64
+
+	trailerNames []string
+	trailers     *headers.Headers
+	dropTrailers bool
+}
+
+// OnWriteHeaders registers fn to run just before the response headers are
+// written, letting middleware add fields after the handler has run its logic.
+func (w *Writer) OnWriteHeaders(fn func(h *headers.Headers)) {
+	w.hooks = append(w.hooks, fn)
+}
+
+// OnWriteBody registers fn to see every body byte the handler writes,
+// before any chunked framing is added.
+func (w *Writer) OnWriteBody(fn func(p []byte)) {
+	w.bodyObservers = append(w.bodyObservers, fn)
+}
+
+func (w *Writer) observe(p []byte) {
+	for _, fn := range w.bodyObservers {
+		fn(p)
+	}
+}
+
+// BodyObserved reports whether OnWriteBody observers saw the whole body.
+// They don't when the handler framed the body itself, or when the status
+// doesn't allow a body.
+func (w *Writer) BodyObserved() bool {
+	return !w.unobserved && w.framing != framingNone
+}
+
+// OnBeforeFinish registers fn to run when Finish starts, before the body
+// is ended. Helpers that write from their own goroutines use it to stop
+// once the handler has returned.
+func (w *Writer) OnBeforeFinish(fn func()) {
+	w.stopHooks = append(w.stopHooks, fn)
+}
+
+// OnFinish registers fn to run once the response is complete, either
+// when Finish is called, when it is aborted or when the connection is
+// hijacked.
+func (w *Writer) OnFinish(fn func()) {
+	w.finishHooks = append(w.finishHooks, fn)
+}
+
+// Abort gives up on a response that can't be completed, without writing
+// anything more. The connection must be dropped afterwards so the client
+// sees the response is cut short; the finish hooks still run.
+func (w *Writer) Abort() {
+	if w.writerState == StateHijacked || w.aborted {
+		return
+	}
+	w.aborted = true
+	w.mustClose = true
+	w.runStopHooks()
+	w.runFinishHooks()
+}
+
+// Aborted reports whether Abort was called, letting finish hooks tell a
+// cut short response from a complete one.
+func (w *Writer) Aborted() bool {
+	return w.aborted
+}
+
+func (w *Writer) runStopHooks() {
+	hooks := w.stopHooks
+	w.stopHooks = nil
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+func (w *Writer) runFinishHooks() {
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// Status returns the status code written so far, or 0 before the status
+// line.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BufferSize is how many body bytes the writer holds back before it has to
+// commit to a framing.
+func (w *Writer) BufferSize() int {
+	return w.out.Size()
+}
+
+// BytesWritten returns how many body bytes went to the client, framing
+// included. HEAD responses and bodyless statuses report 0.
+func (w *Writer) BytesWritten() int64 {
+	return w.bodyBytes
+}
+
+// ContentBytesWritten returns how many body bytes went to the client,
+// leaving out chunk framing and trailers.
+func (w *Writer) ContentBytesWritten() int64 {
+	return w.contentBytes
+}
+
+// PendingHeaders returns the headers the writer is still holding back
+// while it works out the framing, or nil once they have been written.
+// Fields added to it go out with the response.
+func (w *Writer) PendingHeaders() *headers.Headers {
+	if w.writerState == StateBody && w.framing == framingUndecided {
+		return w.header
+	}
+	return nil
 }
 
 func NewWriter(conn io.Writer) *Writer {
+	return NewWriterSize(conn, DEFAULT_WRITE_BUFFER_SIZE)
+}
+
+// NewWriterSize is NewWriter with a write buffer of at least size bytes.
+func NewWriterSize(conn io.Writer, size int) *Writer {
 	return &Writer{
 		writerState: StateStatusCode,
 		conn:        conn,
+		out:         bufio.NewWriterSize(conn, size),
+	}
+}
+
+// NewConnWriter is NewWriter for a live connection. buffered reports the
+// bytes the server has read off conn but not consumed, which Hijack passes
+// on to the new owner.
+func NewConnWriter(conn net.Conn, buffered func() []byte) *Writer {
+	return NewConnWriterSize(conn, buffered, DEFAULT_WRITE_BUFFER_SIZE)
+}
+
+func NewConnWriterSize(conn net.Conn, buffered func() []byte, size int) *Writer {
+	w := NewWriterSize(conn, size)
+	w.buffered = buffered
+	return w
+}
+
+// SetRequestVersion tells the writer which HTTP version the client spoke,
+// so it knows whether chunked encoding is available ("1.1") or not.
+func (w *Writer) SetRequestVersion(version string) {
+	w.requestVersion = version
+}
+
+// SetRequestMethod tells the writer which method the response answers. For
+// HEAD every body byte is dropped while the headers, Content-Length
+// included, are sent as they would be for GET.
+func (w *Writer) SetRequestMethod(method string) {
+	w.omitBody = method == "HEAD"
+}
+
+// MustClose reports whether the response body is delimited by closing the
+// connection, in which case the server can't keep it open.
+func (w *Writer) MustClose() bool {
+	return w.mustClose
+}
+
+// Flush sends everything buffered so far to the connection. Streaming
+// handlers call it whenever the client should see what was written; the
+// server flushes once more after the handler returns. Flushing before the
+// body size is known commits the response to chunked (or close delimited)
+// framing.
+func (w *Writer) Flush() error {
+	if w.writerState == StateHijacked {
+		return ERROR_HIJACKED
+	}
+	if w.writerState == StateBody && w.framing == framingUndecided {
+		if err := w.commitStreaming(); err != nil {
+			return err
+		}
+	}
+	return w.out.Flush()
+}
+
+// Finish completes the response once the handler is done: small bodies
+// get their Content-Length, chunked bodies their last chunk. The server
+// calls it after the handler returns.
+func (w *Writer) Finish() error {
+	if w.writerState == StateHijacked || w.aborted {
+		return nil
+	}
+	defer w.runFinishHooks()
+	w.runStopHooks()
+	var err error
+	if w.writerState == StateHeaders {
+		// the status line is out, the header block still needs its
+		// terminating CRLF
+		err = w.WriteHeaders(headers.NewHeaders())
+	}
+	if err == nil && w.writerState == StateBody {
+		switch w.framing {
+		case framingUndecided:
+			if w.wantsTrailers() {
+				// trailers only exist in chunked bodies
+				if err = w.commitStreaming(); err == nil {
+					_, err = w.WriteChunkedBodyDone()
+				}
+				break
+			}
+			w.header.Replace("Content-Length", strconv.Itoa(len(w.pending)))
+			w.framing = framingLength
+			err = w.writeHeaderBlock(w.header)
+			if err == nil {
+				_, err = w.writeContent(w.pending)
+			}
+			w.pending = nil
+		case framingChunked:
+			if !w.chunkedDone {
+				_, err = w.WriteChunkedBodyDone()
+			}
+		case framingLength:
+			if w.remaining > 0 && !w.omitBody {
+				// the client is still waiting for bytes that will never come
+				w.mustClose = true
+				err = ERROR_BODY_SHORTER_THAN_CONTENT_LENGTH
+			}
+		}
+	}
+	if ferr := w.out.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// commitStreaming picks the framing for a body whose size isn't known up
+// front and writes the held back headers.
+func (w *Writer) commitStreaming() error {
+	if w.requestVersion == "1.0" {
+		w.header.Replace("Connection", "close")
+		w.framing = framingClose
+		w.mustClose = true
+	} else {
+		w.header.Replace("Transfer-Encoding", "chunked")
+		w.framing = framingChunked
+	}
+	if err := w.writeHeaderBlock(w.header); err != nil {
+		return err
+	}
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.framing == framingChunked {
+		_, err = w.writeChunk(pending)
+	} else {
+		_, err = w.writeContent(pending)
 	}
+	return err
+}
+
+// RefuseHijack makes Hijack fail with ERROR_HIJACK_NOT_ALLOWED. The server
+// calls it when it may already be reading the next request off the
+// connection, which would then be shared with the hijacker.
+func (w *Writer) RefuseHijack() {
+	w.hijackRefused = true
+}
+
+// Hijack hands the raw connection over to the caller, along with any bytes
+// the client already sent past the end of the request. From then on the
+// caller owns the connection: the server will neither write to nor close it.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.writerState == StateHijacked {
+		return nil, nil, ERROR_HIJACKED
+	}
+	conn, ok := w.conn.(net.Conn)
+	if !ok {
+		return nil, nil, ERROR_HIJACK_NOT_SUPPORTED
+	}
+	if w.hijackRefused {
+		return nil, nil, ERROR_HIJACK_NOT_ALLOWED
+	}
+	// whatever was written before the hijack (e.g. a 101) must go out first
+	if w.writerState == StateBody && w.framing == framingUndecided {
+		w.framing = framingNone
+		if err := w.writeHeaderBlock(w.header); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := w.out.Flush(); err != nil {
+		return nil, nil, err
+	}
+	w.writerState = StateHijacked
+	w.runFinishHooks()
+
+	// copy, the server's buffer is reused for the next read
+	buffered := []byte{}
+	if w.buffered != nil {
+		buffered = append(buffered, w.buffered()...)
+	}
+	return conn, buffered, nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.writerState == StateHijacked
 }
 
+// WriteChunkedBody writes p as a single chunk. Empty writes are skipped,
+// since a zero sized chunk would end the body.
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	switch w.framing {
+	case framingUndecided:
+		if w.writerState == StateBody {
+			if err := w.commitStreaming(); err != nil {
+				return 0, err
+			}
+			return w.WriteChunkedBody(p)
+		}
+	case framingLength:
+		return 0, fmt.Errorf("cannot write chunks on a response with Content-Length")
+	case framingClose, framingNone:
+		return w.WriteBody(p)
+	}
+	w.observe(p)
+	return w.writeChunk(p)
+}
 
-	return 0, nil
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	chunk := fmt.Appendf(nil, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, CRLF...)
+	_, err := w.writeBody(chunk)
+	if err != nil {
+		return 0, err
+	}
+	if !w.omitBody {
+		w.contentBytes += int64(len(p))
+	}
+	return len(p), nil
 }
 
+// WriteChunkedBodyDone writes the last chunk and the empty trailer section.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-
-	return 0, nil
+	if w.framing == framingUndecided && w.writerState == StateBody {
+		if err := w.commitStreaming(); err != nil {
+			return 0, err
+		}
+	}
+	if w.framing != framingChunked && w.framing != framingRaw {
+		return 0, nil
+	}
+	w.chunkedDone = true
+	return w.writeBody(w.trailerSection())
 }
 
 func (w *Writer) WriteToResponse(b []byte) (int, error) {
@@ -59,11 +485,35 @@ func (w *Writer) WriteToResponse(b []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return w.write(b)
+	return w.WriteBody(b)
+}
+
+// writeBody writes bytes that belong to the message body, which HEAD
+// responses leave out.
+func (w *Writer) writeBody(b []byte) (int, error) {
+	if w.omitBody {
+		return len(b), nil
+	}
+	n, err := w.write(b)
+	w.bodyBytes += int64(n)
+	return n, err
+}
+
+// writeContent writes body bytes that aren't framing and counts them for
+// ContentBytesWritten.
+func (w *Writer) writeContent(b []byte) (int, error) {
+	n, err := w.writeBody(b)
+	if !w.omitBody {
+		w.contentBytes += int64(n)
+	}
+	return n, err
 }
 
 func (w *Writer) write(b []byte) (int, error) {
-	return w.conn.Write(b)
+	if w.writerState == StateHijacked {
+		return 0, ERROR_HIJACKED
+	}
+	return w.out.Write(b)
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
@@ -71,61 +521,167 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 		return fmt.Errorf("invalid Writer State for writing StatusLine")
 	}
 
-	statusLine := []byte{}
-	switch statusCode {
-	case StatusOK:
-		statusLine = []byte(HTTP_VERSION + " 200 OK\r\n")
-	case StatusBadRequest:
-		statusLine = []byte(HTTP_VERSION + " 400 Bad Request\r\n")
-	case StatusInternalServerError:
-		statusLine = []byte(HTTP_VERSION + " 500 Internal Server Error\r\n")
-	default:
+	text, ok := statusText[statusCode]
+	if !ok {
 		return fmt.Errorf("unrecognized status code")
 	}
+	statusLine := fmt.Appendf(nil, "%s %d %s\r\n", HTTP_VERSION, statusCode, text)
 
 	_, err := w.write(statusLine)
 	if err == nil {
+		w.status = statusCode
 		w.writerState = StateHeaders
 	}
 
 	return err
 }
 
+// SetCookie queues c to be sent as its own Set-Cookie field by the next
+// WriteHeaders call. Invalid cookies are rejected here rather than on the wire.
+func (w *Writer) SetCookie(c *headers.Cookie) error {
+	if w.writerState == StateBody {
+		return fmt.Errorf("cannot set cookie after headers are written")
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c)
+	return nil
+}
+
+func bodyAllowed(status StatusCode) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// WriteHeaders sends the response headers. When they declare neither
+// Content-Length nor Transfer-Encoding the writer frames the body itself:
+// the headers are held back until the body either ends small enough to
+// get a Content-Length or grows into a chunked stream.
 func (w *Writer) WriteHeaders(headers *headers.Headers) error {
-	// if w.writerState != StateHeaders {
-	// 	return fmt.Errorf("invalid writer state for writing headers")
-	// }
-	var err error = nil
-	var bytes []byte = []byte{}
-	headers.ForEach(func(n, v string) {
-		bytes = fmt.Appendf(bytes, "%s: %s\r\n", n, v)
-	})
-	bytes = fmt.Append(bytes, "\r\n")
-	_, err = w.write(bytes)
+	if w.writerState == StateBody {
+		return fmt.Errorf("headers already written, use SetTrailer for trailer fields")
+	}
+
+	hooks := w.hooks
+	w.hooks = nil
+	for _, fn := range hooks {
+		fn(headers)
+	}
+	for _, c := range w.cookies {
+		headers.Set("Set-Cookie", c.String())
+	}
+	w.cookies = nil
+	if len(w.trailerNames) > 0 && w.SendsTrailers() && bodyAllowed(w.status) {
+		headers.Replace("Trailer", strings.Join(w.trailerNames, ", "))
+		// trailers only fit in a chunked body
+		headers.Delete("Content-Length")
+	}
+
+	contentLength, hasLength := headers.Get("Content-Length")
+	_, hasEncoding := headers.Get("Transfer-Encoding")
+	switch {
+	case w.writerState == StateHeaders && !bodyAllowed(w.status):
+		w.framing = framingNone
+		// 204 and 1xx can't carry framing fields at all, 304 may repeat
+		// the Content-Length the GET would have had
+		headers.Delete("Transfer-Encoding")
+		if w.status != StatusNotModified {
+			headers.Delete("Content-Length")
+		}
+	case hasEncoding && w.requestVersion == "1.0":
+		// HTTP/1.0 has no chunked coding, the body ends with the connection
+		headers.Delete("Transfer-Encoding")
+		headers.Replace("Connection", "close")
+		w.framing = framingClose
+		w.mustClose = true
+	case hasEncoding:
+		w.framing = framingRaw
+	case hasLength:
+		n, err := strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || n < 0 {
+			return ERROR_INVALID_CONTENT_LENGTH
+		}
+		w.framing = framingLength
+		w.remaining = n
+	default:
+		w.framing = framingUndecided
+		w.header = headers
+		w.writerState = StateBody
+		return nil
+	}
 
+	err := w.writeHeaderBlock(headers)
 	if err == nil {
 		w.writerState = StateBody
 	}
 	return err
 }
 
-func (w *Writer) WriteBody(p []byte) (int, error) {
-	//if w.writerState != StateBody {
-	//	return 0, fmt.Errorf("invalid writer state for writing body")
-	//}
+func (w *Writer) writeFields(headers *headers.Headers) error {
+	var bytes []byte = []byte{}
+	headers.ForEach(func(n, v string) {
+		bytes = fmt.Appendf(bytes, "%s: %s\r\n", n, v)
+	})
+	bytes = fmt.Append(bytes, "\r\n")
+	_, err := w.write(bytes)
+	return err
+}
 
-	return w.write(p)
+func (w *Writer) writeHeaderBlock(headers *headers.Headers) error {
+	w.header = nil
+	return w.writeFields(headers)
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.writerState != StateBody {
+		return w.write(p)
+	}
+	if w.framing != framingRaw && w.framing != framingNone {
+		w.observe(p)
+	} else if len(p) > 0 {
+		// raw bodies are already framed by the handler, observers would
+		// see the framing and miss the content
+		w.unobserved = true
+	}
 
-	return nil
+	switch w.framing {
+	case framingUndecided:
+		if len(w.pending)+len(p) <= w.out.Size() {
+			w.pending = append(w.pending, p...)
+			return len(p), nil
+		}
+		// too big to hold back, start streaming with what we have
+		w.pending = append(w.pending, p...)
+		if err := w.commitStreaming(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	case framingLength:
+		if int64(len(p)) > w.remaining {
+			return 0, ERROR_BODY_EXCEEDS_CONTENT_LENGTH
+		}
+		n, err := w.writeContent(p)
+		w.remaining -= int64(n)
+		return n, err
+	case framingChunked:
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return w.writeChunk(p)
+	case framingNone:
+		return len(p), nil
+	default:
+		return w.writeContent(p)
+	}
 }
 
+// GetDefaultHeaders returns the base response headers. A contentLen of 0
+// leaves Content-Length out so the writer works it out from the body.
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	headers := headers.NewHeaders()
-	headers.Set("Content-Length", strconv.Itoa(contentLen))
-	headers.Set("Connection", "close")
+	if contentLen > 0 {
+		headers.Set("Content-Length", strconv.Itoa(contentLen))
+	}
 	headers.Set("Content-Type", "text/plain")
 
 	return headers
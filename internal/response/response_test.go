@@ -0,0 +1,330 @@
+package response
+
+import (
+	"build-http-protocol/internal/headers"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestBufferedWrites(t *testing.T) {
+	// Test: status line, headers and body leave in one write
+	conn := &countingWriter{}
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := GetDefaultHeaders(5)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, conn.writes)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, conn.writes)
+	assert.Contains(t, conn.String(), "HTTP/1.1 200 OK\r\n")
+	assert.True(t, bytes.HasSuffix(conn.Bytes(), []byte("\r\n\r\nhello")))
+
+	// Test: Flush pushes out partial streams
+	conn = &countingWriter{}
+	w = NewWriter(conn)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, conn.writes)
+	assert.True(t, bytes.HasSuffix(conn.Bytes(), []byte("3\r\nabc\r\n")))
+
+	// Test: writes bigger than the buffer go straight through
+	conn = &countingWriter{}
+	w = NewWriterSize(conn, 16)
+	_, err = w.WriteBody(bytes.Repeat([]byte("x"), 64))
+	require.NoError(t, err)
+	assert.Equal(t, 1, conn.writes)
+}
+
+func TestHijackRequiresConn(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	_, _, err := w.Hijack()
+	assert.Equal(t, ERROR_HIJACK_NOT_SUPPORTED, err)
+}
+
+func writeResponse(t *testing.T, version string, size int, body ...[]byte) (string, error) {
+	var buf bytes.Buffer
+	w := NewWriterSize(&buf, size)
+	w.SetRequestVersion(version)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	for _, b := range body {
+		if _, err := w.WriteBody(b); err != nil {
+			return buf.String(), err
+		}
+	}
+	err := w.Finish()
+	return buf.String(), err
+}
+
+func TestAutomaticFraming(t *testing.T) {
+	// Test: small bodies get a Content-Length
+	out, err := writeResponse(t, "1.1", 64, []byte("hello "), []byte("world"))
+	require.NoError(t, err)
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.True(t, bytes.HasSuffix([]byte(out), []byte("\r\n\r\nhello world")))
+
+	// Test: empty body
+	out, err = writeResponse(t, "1.1", 64)
+	require.NoError(t, err)
+	assert.Contains(t, out, "content-length: 0\r\n")
+
+	// Test: large bodies switch to chunked on HTTP/1.1
+	big := bytes.Repeat([]byte("x"), 100)
+	out, err = writeResponse(t, "1.1", 64, big, []byte("tail"))
+	require.NoError(t, err)
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out, "content-length")
+	assert.Contains(t, out, "64\r\n"+string(big)+"\r\n4\r\ntail\r\n0\r\n\r\n")
+
+	// Test: and to close delimited on HTTP/1.0
+	var buf bytes.Buffer
+	w := NewWriterSize(&buf, 64)
+	w.SetRequestVersion("1.0")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody(big)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.MustClose())
+	assert.Contains(t, buf.String(), "connection: close\r\n")
+	assert.NotContains(t, buf.String(), "transfer-encoding")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), append([]byte("\r\n\r\n"), big...)))
+
+	// Test: Flush commits a streamed response even if it stays small
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("tick"))
+	require.NoError(t, w.Flush())
+	w.WriteBody([]byte("tock"))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "4\r\ntick\r\n4\r\ntock\r\n0\r\n\r\n")
+
+	// Test: a handler asking for chunked gets close delimited on HTTP/1.0
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestVersion("1.0")
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteChunkedBody([]byte("tick"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.Finish())
+	assert.True(t, w.MustClose())
+	assert.NotContains(t, buf.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\ntick"))
+
+	// Test: finishing right after the status line still ends the headers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusNoContent)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+}
+
+func TestDeclaredContentLength(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+
+	// Test: writing past the declared length fails without writing
+	_, err = w.WriteBody([]byte("def"))
+	assert.Equal(t, ERROR_BODY_EXCEEDS_CONTENT_LENGTH, err)
+	_, err = w.WriteBody([]byte("de"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nabcde")))
+
+	// Test: stopping short means the connection has to close
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	w.WriteBody([]byte("ab"))
+	assert.Equal(t, ERROR_BODY_SHORTER_THAN_CONTENT_LENGTH, w.Finish())
+	assert.True(t, w.MustClose())
+}
+
+func TestHeadResponses(t *testing.T) {
+	// Test: body dropped, computed Content-Length kept
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+
+	// Test: declared Content-Length kept even though nothing is written
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(1234))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "content-length: 1234\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+	assert.False(t, w.MustClose())
+
+	// Test: chunks and trailers are dropped too
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("Transfer-Encoding", "chunked")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("abc"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+	assert.NotContains(t, buf.String(), "abc")
+	assert.NotContains(t, buf.String(), "0\r\n\r\n")
+}
+
+func TestBodylessStatus(t *testing.T) {
+	// Test: 204 drops the body and any framing fields
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(StatusNoContent)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "content-length")
+	assert.NotContains(t, buf.String(), "hello")
+
+	// Test: 304 keeps the Content-Length but not the body
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusNotModified)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+}
+
+func TestTrailers(t *testing.T) {
+	// Test: declared trailers are announced and sent after the last chunk
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.DeclareTrailer("X-Checksum"))
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+	require.NoError(t, w.SetTrailer("X-Checksum", "abc"))
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.Contains(t, out, "trailer: X-Checksum\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "5\r\nhello\r\n0\r\nx-checksum: abc\r\n\r\n"))
+
+	// Test: undeclared trailers set while streaming are still sent
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hi"))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.SetTrailer("X-Count", "2"))
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "trailer:")
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nx-count: 2\r\n\r\n"))
+
+	// Test: disallowed fields are rejected
+	w = NewWriter(&buf)
+	assert.Equal(t, ERROR_DISALLOWED_TRAILER, w.DeclareTrailer("Content-Length"))
+	assert.Equal(t, ERROR_DISALLOWED_TRAILER, w.SetTrailer("Host", "example.com"))
+	assert.Equal(t, ERROR_DISALLOWED_TRAILER, w.SetTrailer("transfer-encoding", "chunked"))
+
+	// Test: names must be tokens and values can't break the line
+	assert.Equal(t, ERROR_INVALID_TRAILER, w.DeclareTrailer("X Checksum"))
+	assert.Equal(t, ERROR_INVALID_TRAILER, w.SetTrailer("X-Sum:", "1"))
+	assert.Equal(t, ERROR_INVALID_TRAILER, w.SetTrailer("X-Sum", "1\r\nSet-Cookie: a=b"))
+	assert.Equal(t, ERROR_INVALID_TRAILER, w.SetTrailer("X-Sum", "1\x00"))
+
+	// Test: declaring after the headers went out fails
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	assert.Equal(t, ERROR_TRAILERS_AFTER_HEADERS, w.DeclareTrailer("X-Late"))
+
+	// Test: clients that don't accept trailers get neither Trailer nor the fields
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetAcceptsTrailers(false)
+	w.DeclareTrailer("X-Checksum")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("hello"))
+	w.SetTrailer("X-Checksum", "abc")
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "trailer")
+	assert.NotContains(t, buf.String(), "abc")
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+
+	// Test: WriteTrailers ends a chunked body with the given fields
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Set("Transfer-Encoding", "chunked")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("abc"))
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "3\r\nabc\r\n0\r\nx-sum: 1\r\n\r\n"))
+}
+
+func TestStatusAndBytes(t *testing.T) {
+	// Test: the writer reports the status and body bytes once finished
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	finished := false
+	w.OnFinish(func() { finished = true })
+	assert.Equal(t, StatusCode(0), w.Status())
+	w.WriteStatusLine(StatusBadRequest)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.WriteBody([]byte("bad input"))
+	assert.Equal(t, int64(0), w.BytesWritten())
+	require.NoError(t, w.Finish())
+	assert.True(t, finished)
+	assert.Equal(t, StatusBadRequest, w.Status())
+	assert.Equal(t, int64(9), w.BytesWritten())
+
+	// Test: HEAD responses send no body bytes
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	w.WriteToResponse([]byte("hello"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(0), w.BytesWritten())
+}
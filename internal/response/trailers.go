@@ -0,0 +1,131 @@
+package response
+
+import (
+	"build-http-protocol/internal/headers"
+	"fmt"
+	"strings"
+)
+
+var ERROR_DISALLOWED_TRAILER = fmt.Errorf("field is not allowed in a trailer section")
+var ERROR_TRAILERS_AFTER_HEADERS = fmt.Errorf("trailers must be declared before the headers are written")
+var ERROR_INVALID_TRAILER = fmt.Errorf("invalid trailer field name or value")
+
+// fields a sender must not put in trailers (RFC 9110 section 6.5.1):
+// framing, routing, request modifiers, authentication, response control
+// data and content processing fields
+var disallowedTrailers = map[string]bool{
+	"transfer-encoding":   true,
+	"content-length":      true,
+	"host":                true,
+	"cache-control":       true,
+	"expect":              true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"range":               true,
+	"te":                  true,
+	"if-match":            true,
+	"if-none-match":       true,
+	"if-modified-since":   true,
+	"if-unmodified-since": true,
+	"if-range":            true,
+	"authorization":       true,
+	"www-authenticate":    true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"set-cookie":          true,
+	"cookie":              true,
+	"age":                 true,
+	"expires":             true,
+	"date":                true,
+	"location":            true,
+	"retry-after":         true,
+	"vary":                true,
+	"warning":             true,
+	"content-encoding":    true,
+	"content-type":        true,
+	"content-range":       true,
+	"trailer":             true,
+	"connection":          true,
+	"keep-alive":          true,
+	"upgrade":             true,
+}
+
+func validTrailer(name string) bool {
+	return !disallowedTrailers[strings.ToLower(name)]
+}
+
+// DeclareTrailer announces trailer fields in the Trailer header so the
+// client knows to expect them. It has to be called before WriteHeaders.
+func (w *Writer) DeclareTrailer(names ...string) error {
+	if w.writerState == StateBody {
+		return ERROR_TRAILERS_AFTER_HEADERS
+	}
+	for _, name := range names {
+		if !headers.ValidFieldName(name) {
+			return ERROR_INVALID_TRAILER
+		}
+		if !validTrailer(name) {
+			return ERROR_DISALLOWED_TRAILER
+		}
+	}
+	w.trailerNames = append(w.trailerNames, names...)
+	return nil
+}
+
+// SetTrailer sets a trailer field value, any time before the body ends.
+// Fields that weren't declared are still sent, just not announced.
+func (w *Writer) SetTrailer(name, value string) error {
+	if !headers.ValidFieldName(name) || !headers.ValidFieldValue(value) {
+		return ERROR_INVALID_TRAILER
+	}
+	if !validTrailer(name) {
+		return ERROR_DISALLOWED_TRAILER
+	}
+	if w.trailers == nil {
+		w.trailers = headers.NewHeaders()
+	}
+	w.trailers.Replace(name, value)
+	return nil
+}
+
+// SetAcceptsTrailers records whether the client said it can handle
+// trailers (TE: trailers). When it didn't, trailers are silently dropped.
+func (w *Writer) SetAcceptsTrailers(accepts bool) {
+	w.dropTrailers = !accepts
+}
+
+// WriteTrailers sets every field in h as a trailer and ends the chunked
+// body.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	var err error
+	h.ForEach(func(n, v string) {
+		if err == nil {
+			err = w.SetTrailer(n, v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteChunkedBodyDone()
+	return err
+}
+
+// SendsTrailers reports whether trailers set on w will reach the client.
+func (w *Writer) SendsTrailers() bool {
+	return !w.dropTrailers && w.requestVersion != "1.0"
+}
+
+func (w *Writer) wantsTrailers() bool {
+	return w.SendsTrailers() && (len(w.trailerNames) > 0 || w.trailers != nil)
+}
+
+// trailerSection is the last chunk followed by the trailer fields.
+func (w *Writer) trailerSection() []byte {
+	b := []byte("0\r\n")
+	if w.trailers != nil && w.SendsTrailers() {
+		w.trailers.ForEach(func(n, v string) {
+			b = fmt.Appendf(b, "%s: %s\r\n", n, v)
+		})
+	}
+	return append(b, CRLF...)
+}
@@ -0,0 +1,193 @@
+package secure
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type contextKey struct{}
+
+// NONCE_PLACEHOLDER in a Content-Security-Policy is replaced with a fresh
+// nonce for every response, see Nonce.
+const NONCE_PLACEHOLDER = "{nonce}"
+
+const (
+	DEFAULT_HSTS_MAX_AGE       = 2 * 365 * 24 * time.Hour
+	DEFAULT_CSP                = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"
+	DEFAULT_REFERRER_POLICY    = "strict-origin-when-cross-origin"
+	DEFAULT_PERMISSIONS_POLICY = "camera=(), microphone=(), geolocation=(), payment=()"
+)
+
+// Options lists the headers to add. Empty fields are left out, so start
+// from DefaultOptions for a sensible baseline.
+type Options struct {
+	// HSTSMaxAge of zero leaves Strict-Transport-Security out. Browsers
+	// ignore it on plain HTTP, so it only matters behind a TLS proxy.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	ContentSecurityPolicy string
+	// CSPReportOnly sends the policy as Content-Security-Policy-Report-Only
+	CSPReportOnly bool
+
+	NoSniff           bool
+	ReferrerPolicy    string
+	PermissionsPolicy string
+
+	CrossOriginOpenerPolicy   string
+	CrossOriginEmbedderPolicy string
+	CrossOriginResourcePolicy string
+
+	// Routes adjusts the options for paths under a prefix. Only the
+	// longest matching prefix applies.
+	Routes []Route
+}
+
+// Route changes the options for requests whose path is Prefix or lies
+// under it, e.g. relaxing the CSP for an embedded widget. Matching stops at
+// path segments: "/embed" covers "/embed" and "/embed/x" but not
+// "/embedded".
+type Route struct {
+	Prefix   string
+	Override func(o *Options)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		HSTSMaxAge:                DEFAULT_HSTS_MAX_AGE,
+		HSTSIncludeSubdomains:     true,
+		ContentSecurityPolicy:     DEFAULT_CSP,
+		NoSniff:                   true,
+		ReferrerPolicy:            DEFAULT_REFERRER_POLICY,
+		PermissionsPolicy:         DEFAULT_PERMISSIONS_POLICY,
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginResourcePolicy: "same-origin",
+	}
+}
+
+// Nonce returns the CSP nonce for this request's response, to put in the
+// nonce attribute of inline <script> and <style> tags. It is empty when
+// the policy doesn't use NONCE_PLACEHOLDER.
+func Nonce(req *request.Request) string {
+	nonce, _ := req.Context().Value(contextKey{}).(string)
+	return nonce
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (o *Options) hsts() string {
+	if o.HSTSMaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.Itoa(int(o.HSTSMaxAge/time.Second))
+	if o.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if o.HSTSPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// apply adds the headers the handler didn't set itself, so a handler can
+// still override any of them for a single response.
+func (o *Options) apply(h *headers.Headers, nonce string) {
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if _, ok := h.Get(name); !ok {
+			h.Replace(name, value)
+		}
+	}
+	set("Strict-Transport-Security", o.hsts())
+	csp := strings.ReplaceAll(o.ContentSecurityPolicy, NONCE_PLACEHOLDER, nonce)
+	if o.CSPReportOnly {
+		set("Content-Security-Policy-Report-Only", csp)
+	} else {
+		set("Content-Security-Policy", csp)
+	}
+	if o.NoSniff {
+		set("X-Content-Type-Options", "nosniff")
+	}
+	set("Referrer-Policy", o.ReferrerPolicy)
+	set("Permissions-Policy", o.PermissionsPolicy)
+	set("Cross-Origin-Opener-Policy", o.CrossOriginOpenerPolicy)
+	set("Cross-Origin-Embedder-Policy", o.CrossOriginEmbedderPolicy)
+	set("Cross-Origin-Resource-Policy", o.CrossOriginResourcePolicy)
+}
+
+type routeOptions struct {
+	prefix string
+	opts   Options
+}
+
+// resolve works out every route's options up front, longest prefix first.
+func resolve(base Options) []routeOptions {
+	routes := []routeOptions{}
+	for _, r := range base.Routes {
+		o := base
+		o.Routes = nil
+		r.Override(&o)
+		routes = append(routes, routeOptions{prefix: r.Prefix, opts: o})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes
+}
+
+// underPrefix reports whether path is prefix or one of its sub paths, a
+// trailing slash on prefix being optional.
+func underPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Middleware adds security headers to every response, error responses
+// included.
+func Middleware(opts Options) server.Middleware {
+	routes := resolve(opts)
+	opts.Routes = nil
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			o := &opts
+			for i := range routes {
+				if underPrefix(req.Path(), routes[i].prefix) {
+					o = &routes[i].opts
+					break
+				}
+			}
+
+			var nonce string
+			if strings.Contains(o.ContentSecurityPolicy, NONCE_PLACEHOLDER) {
+				var err error
+				if nonce, err = newNonce(); err != nil {
+					return &server.HandlerError{StatusCode: response.StatusInternalServerError, Message: err.Error()}
+				}
+				req = req.WithContext(context.WithValue(req.Context(), contextKey{}, nonce))
+			}
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				o.apply(h, nonce)
+			})
+			return next(w, req)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package secure
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func run(t *testing.T, opts Options, handler server.Handler, target string) string {
+	req, err := request.RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	if herr := Middleware(opts)(handler)(w, req); herr != nil {
+		h := response.GetDefaultHeaders(len(herr.Message))
+		w.WriteStatusLine(herr.StatusCode)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(herr.Message))
+	}
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func TestDefaults(t *testing.T) {
+	var nonce string
+	page := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		nonce = Nonce(req)
+		w.WriteToResponse([]byte(`<script nonce="` + nonce + `">go()</script>`))
+		return nil
+	}
+
+	// Test: the baseline headers are all there
+	out := run(t, DefaultOptions(), page, "/")
+	assert.Contains(t, out, "strict-transport-security: max-age=63072000; includeSubDomains\r\n")
+	assert.Contains(t, out, "x-content-type-options: nosniff\r\n")
+	assert.Contains(t, out, "referrer-policy: strict-origin-when-cross-origin\r\n")
+	assert.Contains(t, out, "permissions-policy: camera=(), microphone=(), geolocation=(), payment=()\r\n")
+	assert.Contains(t, out, "cross-origin-opener-policy: same-origin\r\n")
+	assert.Contains(t, out, "cross-origin-resource-policy: same-origin\r\n")
+	assert.NotContains(t, out, "cross-origin-embedder-policy")
+
+	// Test: the CSP carries the nonce the handler saw
+	require.Len(t, nonce, 24)
+	assert.Contains(t, out, "script-src 'self' 'nonce-"+nonce+"'; style-src 'self' 'nonce-"+nonce+"'")
+	assert.Contains(t, out, `<script nonce="`+nonce+`">`)
+	assert.NotContains(t, out, NONCE_PLACEHOLDER)
+
+	// Test: every response gets a new nonce
+	first := nonce
+	run(t, DefaultOptions(), page, "/")
+	assert.NotEqual(t, first, nonce)
+
+	// Test: error responses are covered too
+	out = run(t, DefaultOptions(), func(w *response.Writer, req *request.Request) *server.HandlerError {
+		return &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "nope"}
+	}, "/")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out, "x-content-type-options: nosniff\r\n")
+}
+
+func TestOptions(t *testing.T) {
+	hello := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		assert.Empty(t, Nonce(req))
+		w.WriteToResponse([]byte("hello"))
+		return nil
+	}
+
+	// Test: the zero value adds nothing
+	out := run(t, Options{}, hello, "/")
+	for _, name := range []string{"strict-transport", "content-security", "x-content-type", "referrer", "permissions", "cross-origin"} {
+		assert.NotContains(t, out, name)
+	}
+
+	// Test: report-only CSP, preload and COEP
+	out = run(t, Options{
+		HSTSMaxAge:                time.Hour,
+		HSTSPreload:               true,
+		ContentSecurityPolicy:     "default-src 'none'",
+		CSPReportOnly:             true,
+		CrossOriginEmbedderPolicy: "require-corp",
+	}, hello, "/")
+	assert.Contains(t, out, "strict-transport-security: max-age=3600; preload\r\n")
+	assert.Contains(t, out, "content-security-policy-report-only: default-src 'none'\r\n")
+	assert.NotContains(t, out, "content-security-policy:")
+	assert.Contains(t, out, "cross-origin-embedder-policy: require-corp\r\n")
+
+	// Test: a handler's own header wins
+	out = run(t, DefaultOptions(), func(w *response.Writer, req *request.Request) *server.HandlerError {
+		h := response.GetDefaultHeaders(2)
+		h.Replace("Referrer-Policy", "no-referrer")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("hi"))
+		return nil
+	}, "/")
+	assert.Contains(t, out, "referrer-policy: no-referrer\r\n")
+	assert.NotContains(t, out, "strict-origin-when-cross-origin")
+}
+
+func TestRoutes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Routes = []Route{
+		{Prefix: "/embed/", Override: func(o *Options) {
+			o.ContentSecurityPolicy = "frame-ancestors https://partner.example"
+			o.CrossOriginResourcePolicy = "cross-origin"
+		}},
+		{Prefix: "/embed/legacy/", Override: func(o *Options) {
+			o.ContentSecurityPolicy = ""
+		}},
+	}
+	hello := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		w.WriteToResponse([]byte("hello"))
+		return nil
+	}
+
+	// Test: a route overrides only what it changes
+	out := run(t, opts, hello, "/embed/widget?x=1")
+	assert.Contains(t, out, "content-security-policy: frame-ancestors https://partner.example\r\n")
+	assert.Contains(t, out, "cross-origin-resource-policy: cross-origin\r\n")
+	assert.Contains(t, out, "x-content-type-options: nosniff\r\n")
+
+	// Test: the longest prefix wins and may drop a header
+	out = run(t, opts, hello, "/embed/legacy/old")
+	assert.NotContains(t, out, "content-security-policy")
+	assert.Contains(t, out, "cross-origin-resource-policy: same-origin\r\n")
+
+	// Test: other paths keep the base options
+	out = run(t, opts, hello, "/home")
+	assert.Contains(t, out, "frame-ancestors 'none'")
+
+	// Test: prefixes match whole path segments only
+	out = run(t, opts, hello, "/embedded/widget")
+	assert.Contains(t, out, "frame-ancestors 'none'")
+	out = run(t, opts, hello, "/embed")
+	assert.Contains(t, out, "content-security-policy: frame-ancestors https://partner.example\r\n")
+	opts.Routes = []Route{{Prefix: "/api", Override: func(o *Options) { o.ContentSecurityPolicy = "" }}}
+	out = run(t, opts, hello, "/api-docs")
+	assert.Contains(t, out, "frame-ancestors 'none'")
+	out = run(t, opts, hello, "/api/users")
+	assert.NotContains(t, out, "content-security-policy")
+}
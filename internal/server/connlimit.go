@@ -0,0 +1,177 @@
+package server
+
+import (
+	"build-http-protocol/internal/response"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// OverloadMode picks what happens to new connections once the server
+// holds as many as WithMaxConns allows.
+type OverloadMode int
+
+const (
+	// OverloadBlock stops accepting until a connection closes, leaving new
+	// clients waiting in the listen backlog
+	OverloadBlock OverloadMode = iota
+	// OverloadReject accepts anyway and answers 503 Service Unavailable
+	OverloadReject
+)
+
+// how long a rejected client gets to take its 503 before being dropped
+const REJECT_WRITE_TIMEOUT = time.Second
+
+// how many rejected connections get a 503 at once, past that they're
+// closed without one
+const MAX_PENDING_REJECTS = 64
+
+// how long and how much we read from a rejected client before closing, so
+// its unread request doesn't make the close reset the connection and throw
+// away the 503
+const REJECT_DRAIN_TIMEOUT = 100 * time.Millisecond
+const REJECT_DRAIN_BYTES = 4096
+
+var ERROR_SERVER_BUSY = fmt.Errorf("too many connections")
+var ERROR_TOO_MANY_CLIENT_CONNS = fmt.Errorf("too many connections from client")
+
+// connLimiter counts open connections, overall and per client IP. A limit
+// of 0 means unlimited.
+type connLimiter struct {
+	slots chan struct{}
+	perIP int
+	// one per rejected connection still being answered
+	rejects chan struct{}
+
+	mu   sync.Mutex
+	byIP map[string]int
+}
+
+func newConnLimiter(max, perIP int) *connLimiter {
+	l := &connLimiter{perIP: perIP, byIP: map[string]int{}, rejects: make(chan struct{}, MAX_PENDING_REJECTS)}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// reserve waits for a free slot, for OverloadBlock before Accept.
+func (l *connLimiter) reserve() {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+// cancel gives back a slot taken by reserve that no connection used.
+func (l *connLimiter) cancel() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// admit counts conn, taking a slot first unless it was reserved already.
+func (l *connLimiter) admit(conn net.Conn, reserved bool) error {
+	if l.slots != nil && !reserved {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return ERROR_SERVER_BUSY
+		}
+	}
+	if l.perIP > 0 {
+		ip := clientIP(conn)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.byIP[ip] >= l.perIP {
+			l.cancel()
+			return ERROR_TOO_MANY_CLIENT_CONNS
+		}
+		l.byIP[ip]++
+	}
+	return nil
+}
+
+func (l *connLimiter) release(conn net.Conn) {
+	if l.perIP > 0 {
+		ip := clientIP(conn)
+		l.mu.Lock()
+		if l.byIP[ip]--; l.byIP[ip] <= 0 {
+			delete(l.byIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.cancel()
+}
+
+// limitedConn holds its slot until it is closed, whoever owns it by then,
+// so hijacked tunnels and WebSockets keep counting against the limits.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+// track wraps an admitted conn so closing it gives its slot back.
+func (l *connLimiter) track(conn net.Conn) net.Conn {
+	return &limitedConn{Conn: conn, release: sync.OnceFunc(func() { l.release(conn) })}
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// CloseWrite half-closes the connection if the one underneath can.
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// rejectConn answers 503 and closes conn. It runs on its own goroutine
+// so a client that doesn't read can't hold up Accept, and with
+// MAX_PENDING_REJECTS already running conn is just closed.
+func (s *Server) rejectConn(conn net.Conn, reason error) {
+	if s.rejectedConnHook != nil {
+		s.rejectedConnHook(conn, reason)
+	}
+	select {
+	case s.conns.rejects <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-s.conns.rejects }()
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(REJECT_WRITE_TIMEOUT))
+		message := reason.Error()
+		h := response.GetDefaultHeaders(len(message))
+		h.Replace("Connection", "close")
+		w := response.NewWriter(conn)
+		w.WriteStatusLine(response.StatusServiceUnavailable)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(message))
+		if w.Finish() != nil {
+			return
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		conn.SetReadDeadline(time.Now().Add(REJECT_DRAIN_TIMEOUT))
+		io.CopyN(io.Discard, conn, REJECT_DRAIN_BYTES)
+	}()
+}
@@ -0,0 +1,49 @@
+package server
+
+import "net"
+
+// ConnState is a step in a connection's life, reported to the hook set
+// with WithConnStateHook.
+type ConnState int
+
+const (
+	// StateNew is a freshly accepted connection, before its first request
+	StateNew ConnState = iota
+	// StateActive means a request is being handled
+	StateActive
+	// StateIdle is a kept-alive connection waiting for its next request
+	StateIdle
+	// StateHijacked is terminal: the handler took the connection over
+	StateHijacked
+	// StateClosed is terminal: the server closed the connection
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateHijacked:
+		return "hijacked"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *Server) setConnState(conn net.Conn, state ConnState) {
+	if s.connStateHook != nil {
+		s.connStateHook(conn, state)
+	}
+}
+
+func (s *Server) reportParseError(err error) {
+	if s.parseErrorHook != nil {
+		s.parseErrorHook(err)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+type Option func(*Server)
+
+const (
+	DEFAULT_MAX_PIPELINE_DEPTH = 16
+	DEFAULT_MAX_PIPELINE_BYTES = 1 << 20
+	DEFAULT_IDLE_TIMEOUT       = 60 * time.Second
+)
+
+// WithBodyDecoding makes the server undo gzip/deflate Content-Encoding on
+// request bodies before the handler sees them. maxSize bounds the decoded
+// body; zero uses request.DEFAULT_MAX_DECODED_BODY_SIZE.
+func WithBodyDecoding(maxSize int) Option {
+	return func(s *Server) {
+		s.requestOptions.DecodeBody = true
+		s.requestOptions.MaxDecodedBodySize = maxSize
+	}
+}
+
+// WithMaxBodySize bounds request bodies, Content-Length and chunked alike;
+// larger ones are answered with 413. Zero uses
+// request.DEFAULT_MAX_BODY_SIZE.
+func WithMaxBodySize(maxSize int) Option {
+	return func(s *Server) {
+		s.requestOptions.MaxBodySize = maxSize
+	}
+}
+
+// WithDigestVerification makes the server answer 400 to requests whose
+// body doesn't match their Content-Digest or Repr-Digest.
+func WithDigestVerification() Option {
+	return func(s *Server) {
+		s.requestOptions.VerifyDigests = true
+	}
+}
+
+// WithWriteBufferSize sets how many response bytes are buffered before
+// they are written to the connection.
+func WithWriteBufferSize(size int) Option {
+	return func(s *Server) {
+		s.writeBufferSize = size
+	}
+}
+
+// WithAllowedMethods sets the methods advertised in the Allow header of
+// the server-wide "OPTIONS *" response.
+func WithAllowedMethods(methods ...string) Option {
+	return func(s *Server) {
+		s.allowedMethods = methods
+	}
+}
+
+// WithMaxPipelineDepth bounds how many requests are parsed ahead of the one
+// being handled when a client pipelines them on a single connection.
+func WithMaxPipelineDepth(depth int) Option {
+	return func(s *Server) {
+		s.maxPipelineDepth = depth
+	}
+}
+
+// WithMaxPipelineBytes bounds the request bodies held in memory for one
+// connection, the one being handled included: reading ahead stops once
+// they add up to maxBytes. Zero removes the bound.
+func WithMaxPipelineBytes(maxBytes int) Option {
+	return func(s *Server) {
+		s.maxPipelineBytes = maxBytes
+	}
+}
+
+// WithIdleTimeout sets how long a kept-alive connection may sit between
+// requests before it is closed. The timer only runs while no request is
+// being handled.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithConnStateHook calls fn every time a connection changes state. It
+// runs on the connection's goroutine, so it must not block.
+func WithConnStateHook(fn func(conn net.Conn, state ConnState)) Option {
+	return func(s *Server) {
+		s.connStateHook = fn
+	}
+}
+
+// WithParseErrorHook calls fn with every error that stopped a request
+// from being parsed. Clients going away between requests aren't reported.
+func WithParseErrorHook(fn func(err error)) Option {
+	return func(s *Server) {
+		s.parseErrorHook = fn
+	}
+}
+
+// WithPanicHook calls fn with every panic recovered while serving a
+// connection, e.g. to forward it to an error tracker. Panics are logged
+// through slog either way.
+func WithPanicHook(fn func(report *PanicReport)) Option {
+	return func(s *Server) {
+		s.panicHook = fn
+	}
+}
+
+// WithMaxConns bounds how many connections are served at once. What
+// happens to the ones beyond that is up to WithOverloadMode. Hijacked
+// connections count until the handler closes them.
+func WithMaxConns(max int) Option {
+	return func(s *Server) {
+		s.maxConns = max
+	}
+}
+
+// WithMaxConnsPerIP bounds how many connections one client address may
+// hold open. Connections over it are always answered 503, as blocking
+// Accept on one client would stall everybody else.
+func WithMaxConnsPerIP(max int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = max
+	}
+}
+
+// WithOverloadMode picks between waiting for a free slot and rejecting
+// with 503 once WithMaxConns is reached. The default is OverloadBlock.
+func WithOverloadMode(mode OverloadMode) Option {
+	return func(s *Server) {
+		s.overloadMode = mode
+	}
+}
+
+// WithRejectedConnHook calls fn for every connection turned away by the
+// connection limits, with ERROR_SERVER_BUSY or
+// ERROR_TOO_MANY_CLIENT_CONNS as the reason. It runs on the accept loop,
+// so it must not block.
+func WithRejectedConnHook(fn func(conn net.Conn, reason error)) Option {
+	return func(s *Server) {
+		s.rejectedConnHook = fn
+	}
+}
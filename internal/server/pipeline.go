@@ -0,0 +1,189 @@
+package server
+
+import (
+	"build-http-protocol/internal/request"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type parsedRequest struct {
+	req *request.Request
+	err error
+	// the handler might take the connection over (CONNECT, Upgrade), so
+	// nothing past this request may be read until we know it didn't. Only
+	// these requests may be hijacked.
+	mayTakeOver bool
+}
+
+func connectionTokens(req *request.Request) []string {
+	value, _ := req.Headers.Get("connection")
+	tokens := []string{}
+	for _, t := range strings.Split(value, ",") {
+		tokens = append(tokens, strings.ToLower(strings.TrimSpace(t)))
+	}
+	return tokens
+}
+
+// wantsClose reports whether the client expects the connection to end
+// after this request. HTTP/1.0 connections are never kept alive.
+func wantsClose(req *request.Request) bool {
+	return req.RequestLine.HttpVersion == "1.0" || slices.Contains(connectionTokens(req), "close")
+}
+
+func mayTakeOver(req *request.Request) bool {
+	_, upgrade := req.Headers.Get("upgrade")
+	return req.RequestLine.Method == "CONNECT" || upgrade
+}
+
+// isHangup reports whether err means the client is gone.
+func isHangup(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// connPipeline is what readRequests shares with the connection's consumer:
+// the requests read but not answered yet, and the context they carry. The
+// idle timer only runs while there are none, and reading ahead pauses once
+// their bodies add up to maxBytes.
+type connPipeline struct {
+	conn     net.Conn
+	timeout  time.Duration
+	maxBytes int
+	ctx      context.Context
+	hangup   context.CancelFunc
+	// gets a token whenever a request is answered
+	freed chan struct{}
+
+	mu      sync.Mutex
+	pending int
+	bytes   int
+}
+
+func newConnPipeline(s *Server, conn net.Conn) *connPipeline {
+	ctx, cancel := context.WithCancel(context.Background())
+	pl := &connPipeline{
+		conn:     conn,
+		timeout:  s.idleTimeout,
+		maxBytes: s.maxPipelineBytes,
+		ctx:      ctx,
+		hangup:   cancel,
+		freed:    make(chan struct{}, 1),
+	}
+	pl.armIdle()
+	return pl
+}
+
+func (pl *connPipeline) armIdle() {
+	if pl.timeout > 0 {
+		pl.conn.SetReadDeadline(time.Now().Add(pl.timeout))
+	}
+}
+
+// read counts a request handed to the consumer. The connection isn't idle
+// anymore, and a hijacker gets it without our deadline on it.
+func (pl *connPipeline) read(size int) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.pending++
+	pl.bytes += size
+	pl.conn.SetReadDeadline(time.Time{})
+}
+
+// answered counts a request whose response is finished, starting the idle
+// timer if it was the last one.
+func (pl *connPipeline) answered(size int) {
+	pl.mu.Lock()
+	pl.pending--
+	pl.bytes -= size
+	if pl.pending == 0 {
+		pl.armIdle()
+	}
+	pl.mu.Unlock()
+	select {
+	case pl.freed <- struct{}{}:
+	default:
+	}
+}
+
+func (pl *connPipeline) full() bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.maxBytes > 0 && pl.bytes >= pl.maxBytes
+}
+
+// readRequests parses requests off conn ahead of the handler, so pipelined
+// requests are ready as soon as the previous response is out. out's
+// capacity and the pipeline's byte limit cap how far ahead it reads; bytes
+// past that stay unread in the socket. Requests come out in the order they
+// arrived and are answered in that order by the single consumer. They
+// carry the pipeline's context, which is cancelled once the client hangs
+// up so handlers can stop early.
+func readRequests(s *Server, reader *request.ConnReader, pl *connPipeline, out chan<- parsedRequest, resume <-chan struct{}, done <-chan struct{}) {
+	defer close(out)
+	defer func() {
+		// a parser bug takes down this connection, not the process
+		if v := recover(); v != nil {
+			s.reportPanic(v, pl.conn, nil)
+		}
+	}()
+	for {
+		for pl.full() {
+			select {
+			case <-pl.freed:
+			case <-done:
+				return
+			}
+		}
+		req, err := reader.ReadRequest()
+		if isHangup(err) {
+			pl.hangup()
+		}
+
+		p := parsedRequest{req: req, err: err}
+		if err == nil {
+			pl.read(len(req.Body))
+			p.req = req.WithContext(pl.ctx)
+			p.mayTakeOver = mayTakeOver(req)
+		}
+		select {
+		case out <- p:
+		case <-done:
+			return
+		}
+		if err != nil || wantsClose(req) {
+			return
+		}
+
+		if p.mayTakeOver {
+			select {
+			case <-resume:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// acceptsTrailers reports whether the client sent "TE: trailers".
+func acceptsTrailers(req *request.Request) bool {
+	value, _ := req.Headers.Get("te")
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+			return true
+		}
+	}
+	return false
+}
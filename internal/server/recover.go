@@ -0,0 +1,48 @@
+package server
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime/debug"
+)
+
+// PanicReport describes a recovered panic, for WithPanicHook.
+type PanicReport struct {
+	Value      any
+	Stack      []byte
+	RemoteAddr string
+	// Request is nil when the panic didn't happen inside a handler
+	Request *request.Request
+}
+
+func (s *Server) reportPanic(v any, conn net.Conn, req *request.Request) {
+	report := &PanicReport{
+		Value:      v,
+		Stack:      debug.Stack(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Request:    req,
+	}
+	attrs := []any{"remote_addr", report.RemoteAddr, "panic", fmt.Sprint(v), "stack", string(report.Stack)}
+	if req != nil {
+		attrs = append(attrs, "method", req.OriginalMethod(), "target", req.RequestLine.RequestTarget)
+	}
+	slog.Error("recovered from panic", attrs...)
+	if s.panicHook != nil {
+		s.panicHook(report)
+	}
+}
+
+// callHandler runs the handler and recovers if it panics, so one bad
+// request only costs its own connection.
+func (s *Server) callHandler(conn net.Conn, w *response.Writer, req *request.Request) (herr *HandlerError, panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.reportPanic(v, conn, req)
+			panicked = true
+		}
+	}()
+	return s.handler(w, req), false
+}
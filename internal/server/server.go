@@ -1,33 +1,71 @@
 package server
 
 import (
+	"build-http-protocol/internal/headers"
 	"build-http-protocol/internal/request"
 	"build-http-protocol/internal/response"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"time"
 )
 
 type Handler func(w *response.Writer, req *request.Request) *HandlerError
 
+// Middleware wraps a Handler with extra behaviour before and/or after it runs.
+type Middleware func(Handler) Handler
+
+// Chain wraps h so that the first middleware is the outermost one.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
 type Server struct {
-	handler Handler
-	closed  bool
+	handler          Handler
+	closed           bool
+	requestOptions   request.Options
+	writeBufferSize  int
+	allowedMethods   []string
+	maxPipelineDepth int
+	maxPipelineBytes int
+	idleTimeout      time.Duration
+	connStateHook    func(net.Conn, ConnState)
+	parseErrorHook   func(error)
+	panicHook        func(*PanicReport)
+	maxConns         int
+	maxConnsPerIP    int
+	overloadMode     OverloadMode
+	conns            *connLimiter
+	rejectedConnHook func(net.Conn, error)
 }
+
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
 }
 
 func runServer(s *Server, listener net.Listener) {
+	block := s.overloadMode == OverloadBlock
 	for {
+		if block {
+			s.conns.reserve()
+		}
 		conn, err := listener.Accept()
-		if s.closed {
+		if s.closed || err != nil {
+			if block {
+				s.conns.cancel()
+			}
 			return
 		}
-		if err != nil {
-			return
+		if err := s.conns.admit(conn, block); err != nil {
+			s.rejectConn(conn, err)
+			continue
 		}
-		go handleConnection(s, conn)
+		go handleConnection(s, s.conns.track(conn))
 	}
 }
 
@@ -38,43 +76,183 @@ func writeErrors(w *response.Writer, err *HandlerError) {
 	w.WriteBody([]byte(err.Message))
 }
 
-func handleConnection(s *Server, conn net.Conn) {
-	defer conn.Close()
-	// 1. parse the request from connection
-	writer := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
+func parseErrorStatus(err error) response.StatusCode {
+	switch err {
+	case request.ERROR_UNSUPPORTED_CONTENT_ENCODING:
+		return response.StatusUnsupportedMediaType
+	case request.ERROR_DECODED_BODY_TOO_LARGE, request.ERROR_BODY_TOO_LARGE:
+		return response.StatusRequestEntityTooLarge
+	case request.ERROR_REQUEST_HEADER_TOO_LARGE:
+		return response.StatusRequestHeaderFieldsTooLarge
+	case request.ERROR_UNSUPPORTED_TRANSFER_CODING:
+		return response.StatusNotImplemented
+	default:
+		return response.StatusBadRequest
+	}
+}
 
-	if err != nil {
-		writeErrors(writer, &HandlerError{
-			Message:    err.Error(),
+// handleAsterisk answers "OPTIONS *", which asks about the server as a
+// whole rather than any resource, so it never reaches the handler.
+func handleAsterisk(s *Server, w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "OPTIONS" {
+		writeErrors(w, &HandlerError{
 			StatusCode: response.StatusBadRequest,
+			Message:    "asterisk-form is only valid for OPTIONS",
 		})
 		return
 	}
+	h := response.GetDefaultHeaders(0)
+	h.Set("Allow", strings.Join(s.allowedMethods, ", "))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+}
+
+// serveRequest runs one request/response exchange on the connection. It
+// reports whether the connection may carry another request and whether
+// the handler hijacked it.
+func serveRequest(s *Server, conn net.Conn, reader *request.ConnReader, p parsedRequest) (bool, bool) {
+	req := p.req
+	// uploads spilled to disk only live as long as the handler
+	defer req.RemoveMultipartFiles()
+	writer := response.NewConnWriterSize(conn, reader.Buffered, s.writeBufferSize)
+	if !p.mayTakeOver {
+		// readRequests doesn't wait for this one, it may already be
+		// reading what follows
+		writer.RefuseHijack()
+	}
+	writer.SetRequestVersion(req.RequestLine.HttpVersion)
+	writer.SetRequestMethod(req.RequestLine.Method)
+	writer.SetAcceptsTrailers(acceptsTrailers(req))
 
-	// 2. create empty bytes buffer for handler to write to.
-	// 3. call handler function
-	// 4. if handler errs then write the error message to connection
+	req.RemoteAddr = conn.RemoteAddr().String()
 
-	handleError := s.handler(writer, req)
-	if handleError != nil {
-		writeErrors(writer, handleError)
-		return
+	keepAlive := !wantsClose(req) && !s.closed
+	writer.OnWriteHeaders(func(h *headers.Headers) {
+		if !keepAlive {
+			h.Replace("Connection", "close")
+		}
+	})
+
+	if req.RequestLine.RequestTarget == "*" {
+		handleAsterisk(s, writer, req)
+	} else {
+		if req.RequestLine.Method == "HEAD" {
+			req = req.AsGet()
+		}
+
+		handleError, panicked := s.callHandler(conn, writer, req)
+		if panicked {
+			// once the status line is out a 500 can't be sent anymore, so
+			// the connection is dropped to tell the client the response is
+			// incomplete. The same goes for a hijacked connection nobody
+			// owns anymore.
+			if writer.Hijacked() || writer.Status() != 0 {
+				writer.Abort()
+				return false, false
+			}
+			keepAlive = false
+			handleError = &HandlerError{
+				StatusCode: response.StatusInternalServerError,
+				Message:    response.StatusText(response.StatusInternalServerError),
+			}
+		} else if writer.Hijacked() {
+			return false, true
+		}
+		if handleError != nil {
+			writeErrors(writer, handleError)
+		}
 	}
 
-	// 5. if handler succeeds
-	fmt.Printf("We are handling your request CLIENT!\n")
+	if err := writer.Finish(); err != nil {
+		return false, false
+	}
+	return keepAlive && !writer.MustClose(), false
 }
 
-func Serve(port uint16, handler Handler) (*Server, error) {
+func handleConnection(s *Server, conn net.Conn) {
+	reader := request.NewConnReader(conn, s.requestOptions)
+	requests := make(chan parsedRequest, s.maxPipelineDepth)
+	resume := make(chan struct{})
+	done := make(chan struct{})
+	pl := newConnPipeline(s, conn)
+	go readRequests(s, reader, pl, requests, resume, done)
+
+	hijacked := false
+	s.setConnState(conn, StateNew)
+	defer func() {
+		if v := recover(); v != nil {
+			s.reportPanic(v, conn, nil)
+		}
+		close(done)
+		// once hijacked the connection belongs to the handler
+		if hijacked {
+			s.setConnState(conn, StateHijacked)
+			return
+		}
+		pl.hangup()
+		conn.Close()
+		s.setConnState(conn, StateClosed)
+	}()
+
+	for p := range requests {
+		if p.err != nil {
+			// a client closing an idle connection isn't an error worth answering
+			if p.err != io.EOF && !isTimeout(p.err) {
+				s.reportParseError(p.err)
+				writer := response.NewConnWriterSize(conn, reader.Buffered, s.writeBufferSize)
+				// the rest of the stream can't be trusted, so we hang up
+				writer.OnWriteHeaders(func(h *headers.Headers) {
+					h.Replace("Connection", "close")
+				})
+				writeErrors(writer, &HandlerError{
+					Message:    p.err.Error(),
+					StatusCode: parseErrorStatus(p.err),
+				})
+				writer.Finish()
+			}
+			return
+		}
+
+		s.setConnState(conn, StateActive)
+		keepAlive, taken := serveRequest(s, conn, reader, p)
+		if taken {
+			hijacked = true
+			return
+		}
+		if !keepAlive {
+			return
+		}
+		pl.answered(len(p.req.Body))
+		s.setConnState(conn, StateIdle)
+		if p.mayTakeOver {
+			resume <- struct{}{}
+		}
+	}
+}
+
+func newServer(handler Handler, opts ...Option) *Server {
+	server := &Server{
+		handler:          handler,
+		closed:           false,
+		writeBufferSize:  response.DEFAULT_WRITE_BUFFER_SIZE,
+		allowedMethods:   []string{"GET", "HEAD", "POST", "OPTIONS"},
+		maxPipelineDepth: DEFAULT_MAX_PIPELINE_DEPTH,
+		maxPipelineBytes: DEFAULT_MAX_PIPELINE_BYTES,
+		idleTimeout:      DEFAULT_IDLE_TIMEOUT,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	server.conns = newConnLimiter(server.maxConns, server.maxConnsPerIP)
+	return server
+}
+
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
-	server := &Server{
-		handler: handler,
-		closed:  false,
-	}
+	server := newServer(handler, opts...)
 	go runServer(server, listener)
 
 	return server, nil
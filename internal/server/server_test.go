@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bufio"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip feeds raw to handleConnection over a pipe and returns all the
+// server wrote before closing.
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	serverConn, clientConn := net.Pipe()
+	go handleConnection(s, serverConn)
+	go clientConn.Write([]byte(raw))
+	out, err := io.ReadAll(clientConn)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestHead(t *testing.T) {
+	method := ""
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		method = req.RequestLine.Method
+		w.WriteToResponse([]byte("hello world"))
+		return nil
+	})
+
+	out := roundTrip(t, s, "HEAD / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "GET", method)
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.NotContains(t, out, "hello world")
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	called := false
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		called = true
+		return nil
+	}, WithAllowedMethods("GET", "OPTIONS"))
+
+	out := roundTrip(t, s, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, out, "allow: GET, OPTIONS\r\n")
+	assert.False(t, called)
+
+	out = roundTrip(t, s, "GET * HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+	assert.False(t, called)
+}
+
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) testResponse {
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	res := testResponse{status: strings.TrimSpace(status), headers: map[string]string{}}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		res.headers[name] = value
+	}
+	n, _ := strconv.Atoi(res.headers["content-length"])
+	body := make([]byte, n)
+	_, err = io.ReadFull(br, body)
+	require.NoError(t, err)
+	res.body = string(body)
+	return res
+}
+
+func echoTarget(w *response.Writer, req *request.Request) *HandlerError {
+	w.WriteToResponse([]byte(req.RequestLine.RequestTarget))
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go handleConnection(newServer(echoTarget), serverConn)
+	br := bufio.NewReader(clientConn)
+
+	for _, target := range []string{"/one", "/two"} {
+		go clientConn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		res := readResponse(t, br)
+		assert.Equal(t, "HTTP/1.1 200 OK", res.status)
+		assert.Equal(t, target, res.body)
+		assert.NotContains(t, res.headers, "connection")
+	}
+
+	// Test: Connection: close is honoured and echoed
+	go clientConn.Write([]byte("GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	res := readResponse(t, br)
+	assert.Equal(t, "/three", res.body)
+	assert.Equal(t, "close", res.headers["connection"])
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPipelining(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go handleConnection(newServer(echoTarget, WithMaxPipelineDepth(2)), serverConn)
+
+	// every request arrives in a single write, including a body
+	go clientConn.Write([]byte(
+		"GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /c HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /d HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+	br := bufio.NewReader(clientConn)
+	for _, target := range []string{"/a", "/b", "/c", "/d"} {
+		assert.Equal(t, target, readResponse(t, br).body)
+	}
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPipelineBytes(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	release := make(chan struct{})
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		<-release
+		return echoTarget(w, req)
+	}, WithMaxPipelineBytes(10))
+	go handleConnection(s, serverConn)
+
+	// Test: reading ahead stops once the held bodies reach the limit
+	post := func(target, extra string) []byte {
+		return []byte("POST " + target + " HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n" + extra + "\r\n12345678")
+	}
+	_, err := clientConn.Write(post("/a", ""))
+	require.NoError(t, err)
+	_, err = clientConn.Write(post("/b", ""))
+	require.NoError(t, err)
+	written := make(chan struct{})
+	go func() {
+		clientConn.Write(post("/c", "Connection: close\r\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("read past the pipeline byte limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: it resumes as requests are answered
+	close(release)
+	br := bufio.NewReader(clientConn)
+	for _, target := range []string{"/a", "/b", "/c"} {
+		assert.Equal(t, target, readResponse(t, br).body)
+	}
+	<-written
+}
+
+func TestPipelinedHijack(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	taken := make(chan string, 1)
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		conn, buffered, err := w.Hijack()
+		require.NoError(t, err)
+		conn.Write([]byte("switched\n"))
+		taken <- string(buffered)
+		return nil
+	})
+	go handleConnection(s, serverConn)
+
+	// what follows the upgrade request is not HTTP and must not be parsed
+	go clientConn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: custom\r\nConnection: Upgrade\r\n\r\nnot http at all"))
+	line, err := bufio.NewReader(clientConn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "switched\n", line)
+	assert.Equal(t, "not http at all", <-taken)
+}
+
+func TestHijackRefused(t *testing.T) {
+	// Test: a request the reader didn't pause after can't be hijacked, the
+	// next pipelined request may already be read
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	hijackErr := make(chan error, 1)
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		_, _, err := w.Hijack()
+		hijackErr <- err
+		return echoTarget(w, req)
+	})
+	go handleConnection(s, serverConn)
+
+	go clientConn.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	assert.Equal(t, "/a", readResponse(t, bufio.NewReader(clientConn)).body)
+	assert.Equal(t, response.ERROR_HIJACK_NOT_ALLOWED, <-hijackErr)
+}
+
+func TestIdleConnections(t *testing.T) {
+	// Test: a client hanging up between requests gets no error response
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(newServer(echoTarget), serverConn)
+		close(done)
+	}()
+	clientConn.Close()
+	<-done
+
+	// Test: idle connections time out
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	go handleConnection(newServer(echoTarget, WithIdleTimeout(10*time.Millisecond)), serverConn)
+	out, err := io.ReadAll(clientConn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// Test: a handler running past the idle timeout doesn't end the connection
+	slow := func(w *response.Writer, req *request.Request) *HandlerError {
+		time.Sleep(50 * time.Millisecond)
+		return echoTarget(w, req)
+	}
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	go handleConnection(newServer(slow, WithIdleTimeout(10*time.Millisecond)), serverConn)
+	br := bufio.NewReader(clientConn)
+	go clientConn.Write([]byte("GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, "/one", readResponse(t, br).body)
+	go clientConn.Write([]byte("GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, "/two", readResponse(t, br).body)
+}
+
+func TestTrailersNeedTE(t *testing.T) {
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.DeclareTrailer("X-Checksum")
+		w.WriteToResponse([]byte("hello"))
+		w.SetTrailer("X-Checksum", "abc")
+		return nil
+	})
+
+	// Test: the trailer is sent when the client asked for it
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nTE: trailers\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "trailer: X-Checksum\r\n")
+	assert.Contains(t, out, "x-checksum: abc\r\n")
+
+	// Test: otherwise it is dropped
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.NotContains(t, out, "trailer")
+	assert.NotContains(t, out, "abc")
+}
+
+func TestDigestVerification(t *testing.T) {
+	called := false
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		called = true
+		w.WriteToResponse([]byte("ok"))
+		return nil
+	}, WithDigestVerification())
+
+	// Test: a body that doesn't match its digest gets a 400
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+
+		"Content-Digest: sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:\r\n"+
+		"Content-Length: 11\r\n\r\nhello World")
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+	assert.False(t, called)
+}
+
+func TestConnStateAndParseErrorHooks(t *testing.T) {
+	var mu sync.Mutex
+	states := []ConnState{}
+	parseErrors := []error{}
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		w.WriteToResponse([]byte("ok"))
+		return nil
+	}, WithConnStateHook(func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}), WithParseErrorHook(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		parseErrors = append(parseErrors, err)
+	}))
+
+	// Test: a kept-alive request followed by garbage walks every state
+	roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nNOT A REQUEST\r\n\r\n")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle, StateClosed}, states)
+	require.Len(t, parseErrors, 1)
+	assert.Equal(t, request.ERROR_MALFORMED_REQUEST_LINE, parseErrors[0])
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var mu sync.Mutex
+	reports := []*PanicReport{}
+	aborted := []bool{}
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		switch req.Path() {
+		case "/early":
+			var m map[string]int
+			m["boom"] = 1
+		case "/late":
+			w.OnFinish(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				aborted = append(aborted, w.Aborted())
+			})
+			w.WriteStatusLine(response.StatusOK)
+			h := response.GetDefaultHeaders(0)
+			h.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("partial"))
+			w.Flush()
+			panic("halfway through")
+		}
+		w.WriteToResponse([]byte("fine"))
+		return nil
+	}, WithPanicHook(func(report *PanicReport) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, report)
+	}))
+
+	// Test: a panic before any output becomes a 500 and closes the connection
+	out := roundTrip(t, s, "GET /early HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.NotContains(t, out, "fine")
+
+	// Test: a panic mid-response drops the connection without ending the body
+	out = roundTrip(t, s, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, out, "7\r\npartial\r\n")
+	assert.NotContains(t, out, "0\r\n\r\n")
+	assert.NotContains(t, out, "500")
+
+	// Test: the finish hooks still run, seeing the response was cut short
+	mu.Lock()
+	assert.Equal(t, []bool{true}, aborted)
+	mu.Unlock()
+
+	// Test: the hook sees the panic value, stack and request
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, reports, 2)
+	assert.Contains(t, fmt.Sprint(reports[0].Value), "nil map")
+	assert.Contains(t, string(reports[0].Stack), "TestPanicRecovery")
+	assert.Equal(t, "/early", reports[0].Request.Path())
+	assert.Equal(t, "halfway through", reports[1].Value)
+
+	// Test: the server keeps serving other connections
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "fine")
+}
+
+// listen runs s on a loopback listener until the test ends.
+func listen(t *testing.T, s *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go runServer(s, listener)
+	return listener.Addr().String()
+}
+
+// get sends one request on a new connection and returns the response.
+func get(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, _ := io.ReadAll(conn)
+	return string(out)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var rejected []error
+	hook := WithRejectedConnHook(func(conn net.Conn, reason error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rejected = append(rejected, reason)
+	})
+	blocking := func(w *response.Writer, req *request.Request) *HandlerError {
+		<-release
+		w.WriteToResponse([]byte("done"))
+		return nil
+	}
+
+	// Test: reject mode answers 503 while the only slot is taken
+	s := newServer(blocking, WithMaxConns(1), WithOverloadMode(OverloadReject), hook)
+	addr := listen(t, s)
+	first := make(chan string)
+	go func() { first <- get(t, addr) }()
+	require.Eventually(t, func() bool { return len(s.conns.slots) == 1 }, time.Second, time.Millisecond)
+	out := get(t, addr)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+	release <- struct{}{}
+	assert.Contains(t, <-first, "done")
+
+	// Test: with too many rejects in flight, more are closed without a 503
+	go func() { first <- get(t, addr) }()
+	require.Eventually(t, func() bool { return len(s.conns.slots) == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < MAX_PENDING_REJECTS; i++ {
+		s.conns.rejects <- struct{}{}
+	}
+	assert.Empty(t, get(t, addr))
+	for i := 0; i < MAX_PENDING_REJECTS; i++ {
+		<-s.conns.rejects
+	}
+	release <- struct{}{}
+	assert.Contains(t, <-first, "done")
+
+	// Test: the slot frees up once the connection ends
+	require.Eventually(t, func() bool { return len(s.conns.slots) == 0 }, time.Second, time.Millisecond)
+	go func() { release <- struct{}{} }()
+	assert.Contains(t, get(t, addr), "done")
+
+	// Test: block mode holds new connections back instead
+	s = newServer(blocking, WithMaxConns(1))
+	addr = listen(t, s)
+	go func() { first <- get(t, addr) }()
+	require.Eventually(t, func() bool { return len(s.conns.slots) == 1 }, time.Second, time.Millisecond)
+	second := make(chan string)
+	go func() { second <- get(t, addr) }()
+	select {
+	case <-second:
+		t.Fatal("second connection served while the first was still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	assert.Contains(t, <-first, "done")
+	release <- struct{}{}
+	assert.Contains(t, <-second, "done")
+
+	// Test: one client can't hold more than its share
+	s = newServer(blocking, WithMaxConnsPerIP(1), hook)
+	addr = listen(t, s)
+	go func() { first <- get(t, addr) }()
+	require.Eventually(t, func() bool {
+		s.conns.mu.Lock()
+		defer s.conns.mu.Unlock()
+		return s.conns.byIP["127.0.0.1"] == 1
+	}, time.Second, time.Millisecond)
+	assert.Contains(t, get(t, addr), " 503 ")
+	release <- struct{}{}
+	assert.Contains(t, <-first, "done")
+
+	// Test: the hook saw every rejection with its reason
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []error{ERROR_SERVER_BUSY, ERROR_SERVER_BUSY, ERROR_TOO_MANY_CLIENT_CONNS}, rejected)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	var mu sync.Mutex
+	served := []string{}
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		mu.Lock()
+		served = append(served, req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" "+req.Body)
+		mu.Unlock()
+		w.WriteToResponse([]byte("ok"))
+		return nil
+	})
+
+	// Test: a CL.TE payload is refused and the smuggled request never runs
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 35\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\nGET /admin HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 "))
+
+	// Test: parse errors say the connection is closing
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: unsupported codings get 501, oversized headers 431
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented\r\n"))
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nX-Long: "+strings.Repeat("a", request.MAX_BUFFER_SIZE)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large\r\n"))
+
+	// Test: bodies over the configured size get 413
+	limited := newServer(s.handler, WithMaxBodySize(4))
+	out = roundTrip(t, limited, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+	out = roundTrip(t, limited, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\n\r\nabcdef")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+
+	mu.Lock()
+	assert.Empty(t, served)
+	mu.Unlock()
+
+	// Test: a chunked body ends exactly where the next pipelined request starts
+	out = roundTrip(t, s, "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"4\r\nGET \r\n0\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"POST /a GET ", "GET /b "}, served)
+}
+
+func TestRequestContextCancelled(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		select {
+		case <-req.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+		}
+		return nil
+	})
+
+	// Test: a client hanging up mid-request cancels the request context
+	serverConn, clientConn := net.Pipe()
+	go handleConnection(s, serverConn)
+	_, err := clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	clientConn.Close()
+	assert.True(t, <-cancelled)
+}
+
+func TestHijackedConnKeepsSlot(t *testing.T) {
+	taken := make(chan net.Conn, 1)
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		conn, _, err := w.Hijack()
+		require.NoError(t, err)
+		taken <- conn
+		return nil
+	}, WithMaxConns(1), WithOverloadMode(OverloadReject))
+	addr := listen(t, s)
+
+	// Test: the slot stays taken after the handler returns with the conn
+	client, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+	client.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: custom\r\nConnection: Upgrade\r\n\r\n"))
+	conn := <-taken
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, s.conns.slots, 1)
+	assert.Contains(t, get(t, addr), " 503 ")
+
+	// Test: closing the hijacked conn gives it back
+	conn.Close()
+	assert.Len(t, s.conns.slots, 0)
+	_, ok := conn.(interface{ CloseWrite() error })
+	assert.True(t, ok)
+}
+
+func TestMultipartCleanup(t *testing.T) {
+	var tmpFile string
+	s := newServer(func(w *response.Writer, req *request.Request) *HandlerError {
+		req = req.WithContext(req.Context())
+		require.NoError(t, req.ParseMultipartForm(request.FormOptions{MaxMemory: 1}))
+		f, err := req.MultipartForm.File["upload"][0].Open()
+		require.NoError(t, err)
+		tmpFile = f.(*os.File).Name()
+		f.Close()
+		w.WriteToResponse([]byte("ok"))
+		return nil
+	})
+
+	// Test: spilled uploads are removed once the handler returns
+	body := "--xyz\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"a.txt\"\r\n\r\nhello\r\n--xyz--\r\n"
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+
+		"Content-Type: multipart/form-data; boundary=xyz\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	assert.Contains(t, out, "ok")
+	require.NotEmpty(t, tmpFile)
+	_, err := os.Stat(tmpFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,157 @@
+package session
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type contextKey struct{}
+
+const (
+	DEFAULT_COOKIE_NAME      = "session"
+	DEFAULT_IDLE_TIMEOUT     = 30 * time.Minute
+	DEFAULT_ABSOLUTE_TIMEOUT = 24 * time.Hour
+)
+
+type Options struct {
+	CookieName string
+	// IdleTimeout expires sessions that haven't been used for this long,
+	// AbsoluteTimeout expires them this long after creation regardless.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	// cookie attributes; the cookie is always HttpOnly
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite headers.SameSite
+}
+
+func (o Options) withDefaults() Options {
+	if o.CookieName == "" {
+		o.CookieName = DEFAULT_COOKIE_NAME
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+	if o.AbsoluteTimeout <= 0 {
+		o.AbsoluteTimeout = DEFAULT_ABSOLUTE_TIMEOUT
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.SameSite == headers.SameSiteDefault {
+		o.SameSite = headers.SameSiteLax
+	}
+	return o
+}
+
+// Validate reports options that would make every session cookie invalid,
+// such as SameSite=None without Secure.
+func (o Options) Validate() error {
+	return o.withDefaults().cookie("x", 1).Valid()
+}
+
+// FromRequest returns the session attached by Middleware, or nil when the
+// middleware isn't installed.
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+func expired(s *Session, now time.Time, opts Options) bool {
+	return now.Sub(s.LastSeen) > opts.IdleTimeout || now.Sub(s.CreatedAt) > opts.AbsoluteTimeout
+}
+
+func load(store Store, req *request.Request, opts Options, now time.Time) (*Session, bool) {
+	c, err := req.Cookie(opts.CookieName)
+	if err != nil {
+		return newSession(now), true
+	}
+	s, err := store.Load(c.Value)
+	if err != nil {
+		// an unknown ID is never adopted, the client gets a brand new one
+		return newSession(now), true
+	}
+	if expired(s, now, opts) {
+		store.Delete(s)
+		return newSession(now), true
+	}
+	return s, false
+}
+
+func (o Options) cookie(value string, maxAge int) *headers.Cookie {
+	return &headers.Cookie{
+		Name:     o.CookieName,
+		Value:    value,
+		MaxAge:   maxAge,
+		Path:     o.Path,
+		Domain:   o.Domain,
+		Secure:   o.Secure,
+		HttpOnly: true,
+		SameSite: o.SameSite,
+	}
+}
+
+// maxAge converts ttl to whole seconds, rounding up: a Max-Age of 0 would
+// turn the cookie into a session cookie with no expiry at all.
+func maxAge(ttl time.Duration) int {
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+// save persists s and sets its cookie on h, or expires the cookie when s
+// was destroyed.
+func save(store Store, s *Session, isNew bool, h *headers.Headers, opts Options, now time.Time) error {
+	if s.destroyed {
+		store.Delete(s)
+		if isNew {
+			return nil
+		}
+		return h.AddCookie(opts.cookie("", -1))
+	}
+	if isNew && !s.changed {
+		return nil
+	}
+	s.LastSeen = now
+	// never let a session outlive its absolute timeout
+	ttl := min(opts.IdleTimeout, s.CreatedAt.Add(opts.AbsoluteTimeout).Sub(now))
+	value, err := store.Save(s, ttl)
+	if err != nil {
+		return err
+	}
+	return h.AddCookie(opts.cookie(value, maxAge(ttl)))
+}
+
+// Middleware loads the request's session from store, exposes it through
+// FromRequest and writes it back just before the response headers go out.
+// Sessions that were never modified are not persisted, so anonymous
+// traffic doesn't fill the store. It panics if opts don't pass Validate.
+func Middleware(store Store, opts Options) server.Middleware {
+	if err := opts.Validate(); err != nil {
+		panic(fmt.Errorf("session: %w", err))
+	}
+	opts = opts.withDefaults()
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			now := time.Now()
+			s, isNew := load(store, req, opts, now)
+
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				if err := save(store, s, isNew, h, opts, now); err != nil {
+					// the status is already decided, so all that can be done
+					// is to make the lost session visible
+					slog.Error("saving session failed", "error", err)
+				}
+			})
+
+			ctx := context.WithValue(req.Context(), contextKey{}, s)
+			return next(w, req.WithContext(ctx))
+		}
+	}
+}
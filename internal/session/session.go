@@ -0,0 +1,76 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"time"
+)
+
+var ERROR_SESSION_NOT_FOUND = fmt.Errorf("session not found")
+var ERROR_INVALID_SESSION = fmt.Errorf("invalid session")
+
+type Session struct {
+	ID        string            `json:"id"`
+	Values    map[string]string `json:"values"`
+	CreatedAt time.Time         `json:"created_at"`
+	LastSeen  time.Time         `json:"last_seen"`
+
+	previousID string
+	changed    bool
+	destroyed  bool
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newSession(now time.Time) *Session {
+	return &Session{
+		ID:        newID(),
+		Values:    map[string]string{},
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+}
+
+func (s *Session) Get(key string) string {
+	return s.Values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	s.Values[key] = value
+	s.changed = true
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+	s.changed = true
+}
+
+// Regenerate gives the session a fresh ID while keeping its values. Call it
+// whenever privileges change (login, logout, sudo) so an attacker who
+// planted or learned the old ID can't ride along. CreatedAt is kept, so
+// rotating the ID doesn't extend the absolute timeout.
+func (s *Session) Regenerate() {
+	if s.previousID == "" {
+		s.previousID = s.ID
+	}
+	s.ID = newID()
+	s.changed = true
+}
+
+// Destroy drops the session from the store and expires the cookie.
+func (s *Session) Destroy() {
+	s.destroyed = true
+	s.Values = map[string]string{}
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.Values = maps.Clone(s.Values)
+	return &c
+}
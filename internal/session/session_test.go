@@ -0,0 +1,259 @@
+package session
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip runs handler behind the session middleware for a GET carrying
+// cookie and returns the session cookie value the response set, if any.
+func roundTrip(t *testing.T, store Store, opts Options, cookie string, handler server.Handler) string {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if cookie != "" {
+		raw += "Cookie: session=" + cookie + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h := Middleware(store, opts)(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		if handler != nil {
+			if herr := handler(w, req); herr != nil {
+				return herr
+			}
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	})
+	require.Nil(t, h(w, req))
+	w.Finish()
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if value, ok := strings.CutPrefix(line, "set-cookie: session="); ok {
+			value, _, _ = strings.Cut(value, ";")
+			return value
+		}
+	}
+	return ""
+}
+
+func setUser(user string) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		FromRequest(req).Set("user", user)
+		return nil
+	}
+}
+
+func readUser(out *string) server.Handler {
+	return func(w *response.Writer, req *request.Request) *server.HandlerError {
+		*out = FromRequest(req).Get("user")
+		return nil
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	// Test: untouched anonymous sessions are not persisted
+	assert.Equal(t, "", roundTrip(t, store, Options{}, "", nil))
+
+	// Test: values survive a round trip
+	cookie := roundTrip(t, store, Options{}, "", setUser("alice"))
+	require.NotEmpty(t, cookie)
+	user := ""
+	roundTrip(t, store, Options{}, cookie, readUser(&user))
+	assert.Equal(t, "alice", user)
+
+	// Test: tampered cookie yields a fresh session
+	user = ""
+	roundTrip(t, store, Options{}, cookie[:len(cookie)-2]+"xx", readUser(&user))
+	assert.Equal(t, "", user)
+}
+
+func TestSignedCookieStore(t *testing.T) {
+	store, err := NewSignedCookieStore([]byte("secret"))
+	require.NoError(t, err)
+	testStore(t, store)
+
+	// Test: key rotation keeps old cookies valid
+	cookie := roundTrip(t, store, Options{}, "", setUser("bob"))
+	rotated, _ := NewSignedCookieStore([]byte("new secret"), []byte("secret"))
+	user := ""
+	roundTrip(t, rotated, Options{}, cookie, readUser(&user))
+	assert.Equal(t, "bob", user)
+	retired, _ := NewSignedCookieStore([]byte("new secret"))
+	user = ""
+	roundTrip(t, retired, Options{}, cookie, readUser(&user))
+	assert.Equal(t, "", user)
+}
+
+func TestEncryptedCookieStore(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	store, err := NewEncryptedCookieStore(key)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	cookie := roundTrip(t, store, Options{}, "", setUser("carol"))
+	assert.NotContains(t, cookie, "carol")
+
+	_, err = NewEncryptedCookieStore([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+	testStore(t, store)
+
+	// Test: entries expire with the idle timeout
+	s := newSession(time.Now())
+	store.Save(s, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, err := store.Load(s.ID)
+	assert.Equal(t, ERROR_SESSION_NOT_FOUND, err)
+
+	// Test: background sweep evicts stale keys
+	swept := NewMemoryStore(time.Millisecond)
+	defer swept.Close()
+	swept.Save(newSession(time.Now()), time.Millisecond)
+	assert.Eventually(t, func() bool { return swept.Len() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	testStore(t, store)
+
+	_, err = store.Load("../../etc/passwd")
+	assert.Equal(t, ERROR_INVALID_SESSION, err)
+
+	// Test: concurrent saves of one session don't trip over each other
+	s := newSession(time.Now())
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Save(s, time.Minute)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	_, err = store.Load(s.ID)
+	assert.NoError(t, err)
+	leftovers, _ := filepath.Glob(filepath.Join(store.Dir, "tmp_*"))
+	assert.Empty(t, leftovers)
+}
+
+func TestValidateOptions(t *testing.T) {
+	// Test: options every cookie would fail are caught up front
+	assert.NoError(t, Options{}.Validate())
+	assert.Equal(t, headers.ERROR_INVALID_COOKIE_ATTRIBUTE, Options{SameSite: headers.SameSiteNone}.Validate())
+	assert.NoError(t, Options{SameSite: headers.SameSiteNone, Secure: true}.Validate())
+	assert.Equal(t, headers.ERROR_INVALID_COOKIE_NAME, Options{CookieName: "bad name"}.Validate())
+	assert.Panics(t, func() { Middleware(NewMemoryStore(0), Options{SameSite: headers.SameSiteNone}) })
+}
+
+func TestRegenerate(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	cookie := roundTrip(t, store, Options{}, "", setUser("alice"))
+	newCookie := roundTrip(t, store, Options{}, cookie, func(w *response.Writer, req *request.Request) *server.HandlerError {
+		FromRequest(req).Regenerate()
+		return nil
+	})
+	assert.NotEqual(t, cookie, newCookie)
+
+	// the old ID is gone, the new one keeps the values
+	_, err := store.Load(cookie)
+	assert.Equal(t, ERROR_SESSION_NOT_FOUND, err)
+	user := ""
+	roundTrip(t, store, Options{}, newCookie, readUser(&user))
+	assert.Equal(t, "alice", user)
+
+	// Test: a new ID doesn't restart the absolute timeout
+	s := newSession(time.Now().Add(-time.Hour))
+	created := s.CreatedAt
+	s.Regenerate()
+	assert.Equal(t, created, s.CreatedAt)
+}
+
+func TestCookieMaxAge(t *testing.T) {
+	// Test: a TTL under a second still gets a Max-Age, rounded up
+	assert.Equal(t, 1, maxAge(300*time.Millisecond))
+	assert.Equal(t, 2, maxAge(1500*time.Millisecond))
+	assert.Equal(t, 60, maxAge(time.Minute))
+
+	h := headers.NewHeaders()
+	s := newSession(time.Now().Add(-time.Hour))
+	s.Set("user", "alice")
+	store := NewMemoryStore(0)
+	defer store.Close()
+	opts := Options{AbsoluteTimeout: time.Hour + 500*time.Millisecond}.withDefaults()
+	require.NoError(t, save(store, s, true, h, opts, time.Now()))
+	assert.Contains(t, h.Values("set-cookie")[0], "Max-Age=1;")
+
+	// Test: a cookie the browser would reject is an error, not a silent drop
+	h = headers.NewHeaders()
+	opts = Options{SameSite: headers.SameSiteNone}.withDefaults()
+	assert.Equal(t, headers.ERROR_INVALID_COOKIE_ATTRIBUTE, save(store, s, true, h, opts, time.Now()))
+	assert.Empty(t, h.Values("set-cookie"))
+}
+
+func TestExpiry(t *testing.T) {
+	store, _ := NewSignedCookieStore([]byte("secret"))
+	s := newSession(time.Now().Add(-2 * time.Hour))
+	s.Set("user", "alice")
+
+	// Test: idle timeout
+	s.LastSeen = time.Now().Add(-time.Hour)
+	cookie, _ := store.Save(s, time.Hour)
+	user := ""
+	roundTrip(t, store, Options{IdleTimeout: 30 * time.Minute}, cookie, readUser(&user))
+	assert.Equal(t, "", user)
+
+	// Test: absolute timeout even if recently used
+	s.LastSeen = time.Now()
+	cookie, _ = store.Save(s, time.Hour)
+	roundTrip(t, store, Options{AbsoluteTimeout: time.Hour}, cookie, readUser(&user))
+	assert.Equal(t, "", user)
+	roundTrip(t, store, Options{AbsoluteTimeout: 3 * time.Hour}, cookie, readUser(&user))
+	assert.Equal(t, "alice", user)
+}
+
+func TestDestroy(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+	cookie := roundTrip(t, store, Options{}, "", setUser("alice"))
+
+	var buf bytes.Buffer
+	req, _ := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nCookie: session=" + cookie + "\r\n\r\n"))
+	w := response.NewWriter(&buf)
+	Middleware(store, Options{})(func(w *response.Writer, req *request.Request) *server.HandlerError {
+		FromRequest(req).Destroy()
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		return nil
+	})(w, req)
+	w.Finish()
+
+	assert.Contains(t, buf.String(), "set-cookie: session=; Max-Age=0")
+	assert.Equal(t, 0, store.Len())
+}
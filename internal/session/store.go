@@ -0,0 +1,348 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_NO_KEYS = fmt.Errorf("at least one key is required")
+
+// Store persists sessions. Load gets the raw cookie value and Save returns
+// the value to put back in the cookie, so cookie stores can keep the whole
+// session client side while server side stores only hand out the ID.
+type Store interface {
+	Load(cookieValue string) (*Session, error)
+	Save(s *Session, ttl time.Duration) (string, error)
+	Delete(s *Session) error
+}
+
+// SignedCookieStore keeps the session in the cookie itself, readable by the
+// client but HMAC-SHA256 signed. Keys[0] signs; every key is accepted when
+// verifying so old keys can be rotated out gracefully.
+type SignedCookieStore struct {
+	Keys [][]byte
+}
+
+func NewSignedCookieStore(keys ...[]byte) (*SignedCookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ERROR_NO_KEYS
+	}
+	return &SignedCookieStore{Keys: keys}, nil
+}
+
+func sign(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (st *SignedCookieStore) Load(cookieValue string) (*Session, error) {
+	payload, sig, ok := strings.Cut(cookieValue, ".")
+	if !ok {
+		return nil, ERROR_INVALID_SESSION
+	}
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, ERROR_INVALID_SESSION
+	}
+	for _, key := range st.Keys {
+		if !hmac.Equal(sign(key, []byte(payload)), gotSig) {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, ERROR_INVALID_SESSION
+		}
+		s := &Session{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, ERROR_INVALID_SESSION
+		}
+		return s, nil
+	}
+	return nil, ERROR_INVALID_SESSION
+}
+
+func (st *SignedCookieStore) Save(s *Session, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	sig := base64.RawURLEncoding.EncodeToString(sign(st.Keys[0], []byte(payload)))
+	return payload + "." + sig, nil
+}
+
+func (st *SignedCookieStore) Delete(s *Session) error {
+	return nil
+}
+
+// EncryptedCookieStore keeps the session in the cookie sealed with
+// AES-GCM, so the client can neither read nor modify it. Keys must be 16,
+// 24 or 32 bytes; Keys[0] encrypts and every key is tried when decrypting.
+type EncryptedCookieStore struct {
+	aeads []cipher.AEAD
+}
+
+func NewEncryptedCookieStore(keys ...[]byte) (*EncryptedCookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ERROR_NO_KEYS
+	}
+	st := &EncryptedCookieStore{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		st.aeads = append(st.aeads, aead)
+	}
+	return st, nil
+}
+
+func (st *EncryptedCookieStore) Load(cookieValue string) (*Session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cookieValue)
+	if err != nil {
+		return nil, ERROR_INVALID_SESSION
+	}
+	for _, aead := range st.aeads {
+		if len(data) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			continue
+		}
+		s := &Session{}
+		if err := json.Unmarshal(plaintext, s); err != nil {
+			return nil, ERROR_INVALID_SESSION
+		}
+		return s, nil
+	}
+	return nil, ERROR_INVALID_SESSION
+}
+
+func (st *EncryptedCookieStore) Save(s *Session, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	aead := st.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+func (st *EncryptedCookieStore) Delete(s *Session) error {
+	return nil
+}
+
+type memoryEntry struct {
+	session   *Session
+	expiresAt time.Time
+}
+
+// MemoryStore keeps sessions in process memory; the cookie only carries
+// the session ID. Expired entries are dropped on access and by a
+// background sweep every interval until Close is called.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	stop     chan struct{}
+}
+
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	st := &MemoryStore{
+		sessions: map[string]memoryEntry{},
+		stop:     make(chan struct{}),
+	}
+	if interval > 0 {
+		go st.sweep(interval)
+	}
+	return st
+}
+
+func (st *MemoryStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.stop:
+			return
+		case now := <-ticker.C:
+			st.mu.Lock()
+			for id, e := range st.sessions {
+				if now.After(e.expiresAt) {
+					delete(st.sessions, id)
+				}
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+func (st *MemoryStore) Close() {
+	close(st.stop)
+}
+
+func (st *MemoryStore) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+func (st *MemoryStore) Load(cookieValue string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.sessions[cookieValue]
+	if !ok {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(st.sessions, cookieValue)
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+	return e.session.clone(), nil
+}
+
+func (st *MemoryStore) Save(s *Session, ttl time.Duration) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s.previousID != "" {
+		delete(st.sessions, s.previousID)
+	}
+	st.sessions[s.ID] = memoryEntry{session: s.clone(), expiresAt: time.Now().Add(ttl)}
+	return s.ID, nil
+}
+
+func (st *MemoryStore) Delete(s *Session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, s.ID)
+	delete(st.sessions, s.previousID)
+	return nil
+}
+
+// FileStore keeps one JSON file per session in Dir.
+type FileStore struct {
+	Dir string
+}
+
+type fileEntry struct {
+	Session   *Session  `json:"session"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (st *FileStore) path(id string) (string, error) {
+	// IDs come from the client, never let them escape Dir
+	if _, err := base64.RawURLEncoding.DecodeString(id); err != nil || id == "" {
+		return "", ERROR_INVALID_SESSION
+	}
+	return filepath.Join(st.Dir, "sess_"+id), nil
+}
+
+func (st *FileStore) Load(cookieValue string) (*Session, error) {
+	path, err := st.path(cookieValue)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+	e := fileEntry{}
+	if err := json.Unmarshal(data, &e); err != nil || e.Session == nil {
+		return nil, ERROR_INVALID_SESSION
+	}
+	if time.Now().After(e.ExpiresAt) {
+		os.Remove(path)
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+	return e.Session, nil
+}
+
+func (st *FileStore) Save(s *Session, ttl time.Duration) (string, error) {
+	path, err := st.path(s.ID)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(fileEntry{Session: s, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return "", err
+	}
+	// write then rename so a concurrent Load never sees a partial file;
+	// every save gets its own temp file so concurrent saves can't mix
+	f, err := os.CreateTemp(st.Dir, "tmp_*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if s.previousID != "" {
+		if old, err := st.path(s.previousID); err == nil {
+			os.Remove(old)
+		}
+	}
+	return s.ID, nil
+}
+
+func (st *FileStore) Delete(s *Session) error {
+	for _, id := range []string{s.ID, s.previousID} {
+		if path, err := st.path(id); err == nil {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// Cleanup removes every expired session file.
+func (st *FileStore) Cleanup() error {
+	matches, err := filepath.Glob(filepath.Join(st.Dir, "sess_*"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		e := fileEntry{}
+		if json.Unmarshal(data, &e) != nil || now.After(e.ExpiresAt) {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
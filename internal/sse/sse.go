@@ -0,0 +1,194 @@
+package sse
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_INVALID_FIELD = fmt.Errorf("event id and type must not contain newlines")
+var ERROR_STREAM_CLOSED = fmt.Errorf("event stream closed")
+
+const DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the browser how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+type Options struct {
+	// HeartbeatInterval is how often a comment is sent to keep proxies
+	// from timing out an idle stream. Negative disables heartbeats.
+	HeartbeatInterval time.Duration
+}
+
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewStream writes the status line and event-stream headers and, unless
+// disabled, starts sending heartbeat comments. The body is chunked (close
+// delimited for HTTP/1.0) and ended by Close, or by the server once the
+// handler returns; heartbeats stop at the same time.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Replace("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	// with no size known, flushing picks the streaming framing
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:    w,
+		done: make(chan struct{}),
+	}
+	s.lastEventID, _ = req.Headers.Get("last-event-id")
+	w.OnBeforeFinish(s.stop)
+
+	interval := opts.HeartbeatInterval
+	if interval == 0 {
+		interval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	go s.watch(req.Context(), interval)
+	return s, nil
+}
+
+// LastEventID is the ID the browser saw last before reconnecting, empty on
+// the first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the client has gone away, Close was called or the
+// handler returned.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// watch sends heartbeats, if interval is positive, and ends the stream
+// when the request context is cancelled.
+func (s *Stream) watch(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.stop()
+			return
+		case <-tick:
+			s.Comment("heartbeat")
+		}
+	}
+}
+
+// stop ends the stream without writing anything more.
+func (s *Stream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// writeLines prefixes every line of text with field, normalising CR and
+// CRLF line breaks so a stray \r can't split the field.
+func writeLines(b *strings.Builder, field, text string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(field)
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+}
+
+func (s *Stream) send(payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ERROR_STREAM_CLOSED
+	}
+	_, err := s.w.WriteBody([]byte(payload))
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		// a failed write means the client hung up
+		s.closed = true
+		close(s.done)
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ERROR_INVALID_FIELD
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	writeLines(&b, "data: ", e.Data)
+	b.WriteString("\n")
+	return s.send(b.String())
+}
+
+// Comment sends a comment line, which browsers ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	writeLines(&b, ": ", text)
+	b.WriteString("\n")
+	return s.send(b.String())
+}
+
+// Close stops heartbeats and ends the body.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
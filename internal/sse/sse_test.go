@@ -0,0 +1,144 @@
+package sse
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func newRequest(t *testing.T, extra string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestStream(t *testing.T) {
+	buf := &syncBuffer{}
+	s, err := NewStream(response.NewWriter(buf), newRequest(t, "Last-Event-ID: 41\r\n"), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+
+	require.NoError(t, s.Send(Event{ID: "42", Event: "progress", Data: "line one\nline two\r\nline three", Retry: 3 * time.Second}))
+	require.NoError(t, s.Comment("hi"))
+	require.NoError(t, s.Close())
+
+	out := buf.String()
+	assert.Contains(t, out, "content-type: text/event-stream\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out, "content-length")
+
+	event := "id: 42\nevent: progress\nretry: 3000\ndata: line one\ndata: line two\ndata: line three\n\n"
+	assert.Contains(t, out, fmt.Sprintf("%x\r\n%s\r\n", len(event), event))
+	assert.Contains(t, out, "6\r\n: hi\n\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "0\r\n\r\n"))
+
+	// Test: closed streams reject writes
+	assert.Equal(t, ERROR_STREAM_CLOSED, s.Send(Event{Data: "late"}))
+}
+
+func TestInvalidFields(t *testing.T) {
+	s, err := NewStream(response.NewWriter(&syncBuffer{}), newRequest(t, ""), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	assert.Equal(t, ERROR_INVALID_FIELD, s.Send(Event{ID: "1\n2", Data: "x"}))
+	assert.Equal(t, ERROR_INVALID_FIELD, s.Send(Event{Event: "a\rb", Data: "x"}))
+}
+
+func TestHeartbeat(t *testing.T) {
+	buf := &syncBuffer{}
+	s, err := NewStream(response.NewWriter(buf), newRequest(t, ""), Options{HeartbeatInterval: time.Millisecond})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return strings.Contains(buf.String(), ": heartbeat\n\n") }, time.Second, time.Millisecond)
+	s.Close()
+}
+
+func TestClientDisconnect(t *testing.T) {
+	// headers are fine, then the connection drops
+	buf := &syncBuffer{}
+	w := response.NewWriter(buf)
+	s, err := NewStream(w, newRequest(t, ""), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	s.w = response.NewWriter(brokenWriter{})
+
+	assert.Error(t, s.Send(Event{Data: "lost"}))
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("stream should be done after a failed write")
+	}
+	assert.Equal(t, ERROR_STREAM_CLOSED, s.Send(Event{Data: "again"}))
+}
+
+func TestHandlerReturns(t *testing.T) {
+	// Test: without Close, Finish still ends the chunked body and stops heartbeats
+	buf := &syncBuffer{}
+	w := response.NewWriter(buf)
+	s, err := NewStream(w, newRequest(t, ""), Options{HeartbeatInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, s.Send(Event{Data: "x"}))
+	require.NoError(t, w.Finish())
+	out := buf.String()
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "0\r\n\r\n"))
+	<-s.Done()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, out, buf.String())
+
+	// Test: HTTP/1.0 clients get a close delimited body
+	buf = &syncBuffer{}
+	w = response.NewWriter(buf)
+	w.SetRequestVersion("1.0")
+	s, err = NewStream(w, newRequest(t, ""), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	require.NoError(t, s.Send(Event{Data: "x"}))
+	require.NoError(t, s.Close())
+	assert.NotContains(t, buf.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\ndata: x\n\n"))
+	assert.True(t, w.MustClose())
+}
+
+func TestContextCancelled(t *testing.T) {
+	// Test: the stream ends when the request context is cancelled
+	ctx, cancel := context.WithCancel(t.Context())
+	req := newRequest(t, "").WithContext(ctx)
+	s, err := NewStream(response.NewWriter(&syncBuffer{}), req, Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream should be done once the context is cancelled")
+	}
+	assert.Equal(t, ERROR_STREAM_CLOSED, s.Send(Event{Data: "late"}))
+}
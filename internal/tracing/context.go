@@ -0,0 +1,197 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var ERROR_INVALID_TRACEPARENT = fmt.Errorf("invalid traceparent")
+var ERROR_INVALID_TRACESTATE = fmt.Errorf("invalid tracestate")
+
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+)
+
+// limits from W3C Trace Context
+const (
+	MAX_TRACESTATE_MEMBERS = 32
+	MAX_TRACESTATE_LENGTH  = 512
+)
+
+const FLAG_SAMPLED byte = 0x01
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+func newTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		rand.Read(t[:])
+	}
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		rand.Read(s[:])
+	}
+	return s
+}
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FLAG_SAMPLED != 0
+}
+
+// Traceparent renders the version 00 traceparent value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTraceparent validates a traceparent value. Versions above 00 may
+// append fields, which are ignored; version ff is invalid.
+func ParseTraceparent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, ERROR_INVALID_TRACEPARENT
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || !isLowerHex(version) || version == "ff" {
+		return sc, ERROR_INVALID_TRACEPARENT
+	}
+	if version == "00" && len(parts) != 4 {
+		return sc, ERROR_INVALID_TRACEPARENT
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 ||
+		!isLowerHex(traceID) || !isLowerHex(spanID) || !isLowerHex(flags) {
+		return sc, ERROR_INVALID_TRACEPARENT
+	}
+
+	hex.Decode(sc.TraceID[:], []byte(traceID))
+	hex.Decode(sc.SpanID[:], []byte(spanID))
+	var f [1]byte
+	hex.Decode(f[:], []byte(flags))
+	sc.Flags = f[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ERROR_INVALID_TRACEPARENT
+	}
+	return sc, nil
+}
+
+func validTracestateKey(key string) bool {
+	simple := func(k string, maxLen int, firstDigit bool) bool {
+		if k == "" || len(k) > maxLen {
+			return false
+		}
+		if !(k[0] >= 'a' && k[0] <= 'z' || firstDigit && k[0] >= '0' && k[0] <= '9') {
+			return false
+		}
+		for i := 1; i < len(k); i++ {
+			c := k[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '*' || c == '/') {
+				return false
+			}
+		}
+		return true
+	}
+	if tenant, system, ok := strings.Cut(key, "@"); ok {
+		return simple(tenant, 241, true) && simple(system, 14, false)
+	}
+	return simple(key, 256, false)
+}
+
+func validTracestateValue(value string) bool {
+	if value == "" || len(value) > 256 || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] > 0x7e || value[i] == ',' || value[i] == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTracestate validates a tracestate value and returns it normalized.
+// One bad member makes the whole value invalid, and vendors' state must
+// then be dropped rather than passed on.
+func ParseTracestate(value string) (string, error) {
+	members := []string{}
+	seen := map[string]bool{}
+	for _, member := range strings.Split(value, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(member, "=")
+		if !ok || !validTracestateKey(key) || !validTracestateValue(val) || seen[key] {
+			return "", ERROR_INVALID_TRACESTATE
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > MAX_TRACESTATE_MEMBERS {
+		return "", ERROR_INVALID_TRACESTATE
+	}
+	state := strings.Join(members, ",")
+	if len(state) > MAX_TRACESTATE_LENGTH {
+		return "", ERROR_INVALID_TRACESTATE
+	}
+	return state, nil
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithSpan makes s the parent of spans started from ctx.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the active span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent records a parent received from another process.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func remoteParent(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
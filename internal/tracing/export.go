@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DEFAULT_OTLP_ENDPOINT = "http://localhost:4318/v1/traces"
+const DEFAULT_EXPORT_TIMEOUT = 5 * time.Second
+
+var ERROR_EXPORT_REJECTED = fmt.Errorf("collector rejected spans")
+
+// StdoutExporter writes one JSON object per span, for local debugging.
+type StdoutExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewStdoutExporter(out io.Writer) *StdoutExporter {
+	return &StdoutExporter{out: out}
+}
+
+type jsonSpan struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	TraceState string         `json:"trace_state,omitempty"`
+	Name       string         `json:"name"`
+	Kind       string         `json:"kind"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMs float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func (e *StdoutExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.out)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:    s.sc.TraceID.String(),
+			SpanID:     s.sc.SpanID.String(),
+			TraceState: s.sc.TraceState,
+			Name:       s.Name,
+			Kind:       s.Kind.String(),
+			Start:      s.Start,
+			End:        s.End,
+			DurationMs: float64(s.End.Sub(s.Start).Microseconds()) / 1000,
+			Attributes: s.Attributes(),
+			Error:      s.Error,
+		}
+		if s.ParentID.IsValid() {
+			js.ParentID = s.ParentID.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP
+// with the JSON encoding.
+type OTLPExporter struct {
+	// Endpoint defaults to DEFAULT_OTLP_ENDPOINT
+	Endpoint    string
+	ServiceName string
+	// Client defaults to one with DEFAULT_EXPORT_TIMEOUT
+	Client *http.Client
+}
+
+// OTLP/JSON message shapes, just the fields we fill in
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, v any) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := v.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+// OTLP status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func toOTLP(s *Span) otlpSpan {
+	out := otlpSpan{
+		TraceID:           s.sc.TraceID.String(),
+		SpanID:            s.sc.SpanID.String(),
+		TraceState:        s.sc.TraceState,
+		Name:              s.Name,
+		Kind:              int(s.Kind),
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusUnset},
+	}
+	if s.ParentID.IsValid() {
+		out.ParentSpanID = s.ParentID.String()
+	}
+	attrs := s.Attributes()
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.Attributes = append(out.Attributes, otlpAttr(k, attrs[k]))
+	}
+	if s.Error != "" {
+		out.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+	}
+	return out
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "build-http-protocol/internal/tracing"
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, toOTLP(s))
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", e.ServiceName)}
+	body := otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = DEFAULT_OTLP_ENDPOINT
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: DEFAULT_EXPORT_TIMEOUT}
+	}
+	res, err := client.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", ERROR_EXPORT_REJECTED, res.Status)
+	}
+	return nil
+}
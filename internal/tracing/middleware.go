@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"strconv"
+	"time"
+)
+
+// remoteContext reads the caller's span context from the request. An
+// invalid traceparent means starting a fresh trace, and an invalid
+// tracestate is dropped while the traceparent is still honoured.
+func remoteContext(req *request.Request) (SpanContext, bool) {
+	values := req.Headers.Values(TRACEPARENT_HEADER)
+	if len(values) != 1 {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(values[0])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if state, ok := req.Headers.Get(TRACESTATE_HEADER); ok {
+		sc.TraceState, _ = ParseTracestate(state)
+	}
+	return sc, true
+}
+
+// Middleware starts a server span per request, continuing the caller's
+// trace when it sent a valid traceparent. Besides the request span it
+// records the header parse, handler and response write phases as child
+// spans. Handlers reach the span through SpanFromContext(req.Context()).
+func Middleware(t *Tracer) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) *server.HandlerError {
+			ctx := req.Context()
+			if sc, ok := remoteContext(req); ok {
+				ctx = ContextWithRemoteParent(ctx, sc)
+			}
+
+			method := req.OriginalMethod()
+			parseStart, headersDone, _ := req.ParseTiming()
+			start := parseStart
+			if start.IsZero() {
+				start = time.Now()
+			}
+			span := t.newSpan(ctx, method, SpanKindServer, start)
+			span.SetAttribute("http.request.method", method)
+			span.SetAttribute("url.path", req.Path())
+			span.SetAttribute("network.protocol.version", req.RequestLine.HttpVersion)
+			if req.RemoteAddr != "" {
+				span.SetAttribute("client.address", req.RemoteAddr)
+			}
+			if ua, ok := req.Headers.Get("user-agent"); ok {
+				span.SetAttribute("user_agent.original", ua)
+			}
+
+			var handlerStart, handlerEnd, writeStart time.Time
+			w.OnWriteHeaders(func(h *headers.Headers) {
+				writeStart = time.Now()
+			})
+			w.OnFinish(func() {
+				span.End = time.Now()
+				status := w.Status()
+				span.SetAttribute("http.response.status_code", int(status))
+				span.SetAttribute("http.response.body.size", w.ContentBytesWritten())
+				if status >= 500 {
+					span.Error = strconv.Itoa(int(status)) + " " + response.StatusText(status)
+				}
+				if handlerEnd.IsZero() {
+					// hijacked while the handler was still running
+					handlerEnd = span.End
+				}
+				if writeStart.IsZero() {
+					writeStart = handlerEnd
+				}
+
+				spans := []*Span{span}
+				if !parseStart.IsZero() && !headersDone.IsZero() {
+					spans = append(spans, t.child(span, "parse headers", parseStart, headersDone))
+				}
+				spans = append(spans,
+					t.child(span, "handler", handlerStart, handlerEnd),
+					t.child(span, "write response", writeStart, span.End))
+				t.export(spans...)
+			})
+
+			handlerStart = time.Now()
+			err := next(w, req.WithContext(ContextWithSpan(ctx, span)))
+			handlerEnd = time.Now()
+			return err
+		}
+	}
+}
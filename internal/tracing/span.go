@@ -0,0 +1,278 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+type Span struct {
+	Name     string
+	Kind     SpanKind
+	ParentID SpanID
+	Start    time.Time
+	End      time.Time
+	// Error is set when the operation failed
+	Error string
+
+	mu         sync.Mutex
+	attributes map[string]any
+	sc         SpanContext
+	tracer     *Tracer
+}
+
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+// SetAttribute records a string, bool, integer or float attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the span's attributes.
+func (s *Span) Attributes() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make(map[string]any, len(s.attributes))
+	for k, v := range s.attributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// Finish ends the span now and queues it for export if it was sampled.
+func (s *Span) Finish() {
+	s.End = time.Now()
+	s.tracer.export(s)
+}
+
+// Exporter ships finished spans somewhere.
+type Exporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+const DEFAULT_QUEUE_SIZE = 2048
+const DEFAULT_BATCH_SIZE = 512
+const DEFAULT_BATCH_INTERVAL = 5 * time.Second
+
+// BatchOptions tunes how a Tracer hands spans to its exporter.
+type BatchOptions struct {
+	// QueueSize caps the spans waiting for export, more are dropped.
+	// Defaults to DEFAULT_QUEUE_SIZE.
+	QueueSize int
+	// BatchSize is the most spans sent in one export, defaults to
+	// DEFAULT_BATCH_SIZE
+	BatchSize int
+	// Interval is how long a partial batch waits, defaults to
+	// DEFAULT_BATCH_INTERVAL
+	Interval time.Duration
+}
+
+// Tracer creates spans and exports the sampled ones in batches from a
+// background goroutine, so a slow collector never holds up a request.
+type Tracer struct {
+	exporter Exporter
+	queue    chan *Span
+	flushes  chan chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	stopped  atomic.Bool
+	dropped  atomic.Uint64
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return NewBatchTracer(exporter, BatchOptions{})
+}
+
+func NewBatchTracer(exporter Exporter, opts BatchOptions) *Tracer {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_BATCH_INTERVAL
+	}
+	t := &Tracer{
+		exporter: exporter,
+		queue:    make(chan *Span, opts.QueueSize),
+		flushes:  make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if exporter == nil {
+		close(t.done)
+		return t
+	}
+	go t.run(opts)
+	return t
+}
+
+// export queues the sampled spans, dropping them when the queue is full.
+func (t *Tracer) export(spans ...*Span) {
+	if t.exporter == nil || t.stopped.Load() {
+		return
+	}
+	for _, s := range spans {
+		if !s.sc.Sampled() {
+			continue
+		}
+		select {
+		case t.queue <- s:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+func (t *Tracer) run(opts BatchOptions) {
+	defer close(t.done)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, opts.BatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// a broken collector shouldn't take requests down with it
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			slog.Warn("exporting spans failed", "error", err, "spans", len(batch))
+		}
+		batch = make([]*Span, 0, opts.BatchSize)
+	}
+	add := func(s *Span) {
+		batch = append(batch, s)
+		if len(batch) >= opts.BatchSize {
+			send()
+		}
+	}
+	// drain sends everything queued so far
+	drain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				add(s)
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			add(s)
+		case <-ticker.C:
+			send()
+		case reply := <-t.flushes:
+			drain()
+			close(reply)
+		case <-t.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush exports every span queued before the call and waits until that's
+// done or ctx ends.
+func (t *Tracer) Flush(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case t.flushes <- reply:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the tracer, exporting the spans still queued, and waits
+// until that's done or ctx ends. Spans finished afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() {
+		t.stopped.Store(true)
+		close(t.stop)
+	})
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dropped returns how many sampled spans were dropped because the export
+// queue was full.
+func (t *Tracer) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+// Start begins a span. Its parent is the span active in ctx, or else a
+// remote parent recorded with ContextWithRemoteParent; without either it
+// starts a new, sampled trace. The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	s := t.newSpan(ctx, name, kind, time.Now())
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newSpan(ctx context.Context, name string, kind SpanKind, start time.Time) *Span {
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      start,
+		attributes: map[string]any{},
+		tracer:     t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.sc = parent.sc
+		s.ParentID = parent.sc.SpanID
+	} else if remote, ok := remoteParent(ctx); ok {
+		s.sc = remote
+		s.ParentID = remote.SpanID
+	} else {
+		s.sc = SpanContext{TraceID: newTraceID(), Flags: FLAG_SAMPLED}
+	}
+	s.sc.SpanID = newSpanID()
+	return s
+}
+
+// child records a phase of parent that has already happened.
+func (t *Tracer) child(parent *Span, name string, start, end time.Time) *Span {
+	s := t.newSpan(ContextWithSpan(context.Background(), parent), name, SpanKindInternal, start)
+	s.End = end
+	return s
+}
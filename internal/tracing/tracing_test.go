@@ -0,0 +1,281 @@
+package tracing
+
+import (
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"build-http-protocol/internal/server"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) byName(name string) *Span {
+	for _, s := range e.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	// Test: a valid version 00 value
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// Test: future versions may carry extra fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	require.NoError(t, err)
+
+	// Test: invalid values
+	for _, value := range []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.Equal(t, ERROR_INVALID_TRACEPARENT, err, value)
+	}
+}
+
+func TestParseTracestate(t *testing.T) {
+	// Test: valid members, including multi-tenant keys
+	state, err := ParseTracestate("congo=t61rcWkgMzE, tenant@vendor=x,, rojo=00f067aa0ba902b7")
+	require.NoError(t, err)
+	assert.Equal(t, "congo=t61rcWkgMzE,tenant@vendor=x,rojo=00f067aa0ba902b7", state)
+
+	// Test: bad keys, values, duplicates and too many members
+	for _, value := range []string{"Congo=x", "congo=a=b", "congo=x,congo=y", "congo", "a=b,=x", "congo=caf\u00e9"} {
+		_, err := ParseTracestate(value)
+		assert.Equal(t, ERROR_INVALID_TRACESTATE, err, value)
+	}
+	members := []string{}
+	for i := 0; i < 33; i++ {
+		members = append(members, "k"+string(rune('a'+i%26))+strings.Repeat("x", i/26)+"=v")
+	}
+	_, err = ParseTracestate(strings.Join(members, ","))
+	assert.Equal(t, ERROR_INVALID_TRACESTATE, err)
+}
+
+func run(t *testing.T, tracer *Tracer, handler server.Handler, extra string) string {
+	reader := request.NewConnReader(strings.NewReader("GET /items?id=7 HTTP/1.1\r\nHost: localhost\r\n"+extra+"\r\n"), request.Options{})
+	req, err := reader.ReadRequest()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	require.Nil(t, Middleware(tracer)(handler)(w, req))
+	require.NoError(t, w.Finish())
+	require.NoError(t, tracer.Flush(t.Context()))
+	return buf.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+	var active *Span
+	handler := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		active = SpanFromContext(req.Context())
+		w.WriteToResponse([]byte("hello"))
+		return nil
+	}
+
+	// Test: the caller's trace is continued, with a span per phase
+	run(t, tracer, handler, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: congo=t61rcWkgMzE\r\n")
+	root := exporter.byName("GET")
+	require.NotNil(t, root)
+	assert.Same(t, active, root)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.Context().TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentID.String())
+	assert.Equal(t, "congo=t61rcWkgMzE", root.Context().TraceState)
+	assert.Equal(t, SpanKindServer, root.Kind)
+	assert.Equal(t, 200, root.Attributes()["http.response.status_code"])
+	assert.Equal(t, "/items", root.Attributes()["url.path"])
+	for _, name := range []string{"parse headers", "handler", "write response"} {
+		child := exporter.byName(name)
+		require.NotNil(t, child, name)
+		assert.Equal(t, root.Context().SpanID, child.ParentID)
+		assert.Equal(t, root.Context().TraceID, child.Context().TraceID)
+		assert.False(t, child.End.Before(child.Start), name)
+	}
+
+	// Test: a bad traceparent starts a new trace and drops the tracestate
+	exporter.spans = nil
+	run(t, tracer, handler, "traceparent: 00-xyz-00f067aa0ba902b7-01\r\ntracestate: congo=t61rcWkgMzE\r\n")
+	root = exporter.byName("GET")
+	assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.Context().TraceID.String())
+	assert.False(t, root.ParentID.IsValid())
+	assert.Empty(t, root.Context().TraceState)
+
+	// Test: unsampled traces are propagated but not exported
+	exporter.spans = nil
+	run(t, tracer, handler, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n")
+	assert.Empty(t, exporter.spans)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", active.Context().TraceID.String())
+}
+
+func TestTransportPropagates(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+	client := &http.Client{Transport: &Transport{Tracer: tracer}}
+	handler := func(w *response.Writer, req *request.Request) *server.HandlerError {
+		outbound, _ := http.NewRequestWithContext(req.Context(), "GET", upstream.URL, nil)
+		res, err := client.Do(outbound)
+		require.NoError(t, err)
+		res.Body.Close()
+		w.WriteToResponse([]byte("proxied"))
+		return nil
+	}
+
+	// Test: the outbound request carries a client span of the same trace
+	run(t, tracer, handler, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: congo=x\r\n")
+	clientSpan := exporter.byName("GET")
+	require.NotNil(t, clientSpan)
+	assert.Equal(t, SpanKindClient, clientSpan.Kind)
+	assert.Equal(t, clientSpan.Context().Traceparent(), received.Get("traceparent"))
+	assert.Equal(t, "congo=x", received.Get("tracestate"))
+	var server *Span
+	for _, s := range exporter.spans {
+		if s.Kind == SpanKindServer {
+			server = s
+		}
+	}
+	require.NotNil(t, server)
+	assert.Equal(t, server.Context().SpanID, clientSpan.ParentID)
+}
+
+// blockingExporter holds every export until release is closed.
+type blockingExporter struct {
+	memoryExporter
+	release chan struct{}
+}
+
+func (e *blockingExporter) ExportSpans(spans []*Span) error {
+	<-e.release
+	return e.memoryExporter.ExportSpans(spans)
+}
+
+func TestBatchExport(t *testing.T) {
+	exporter := &blockingExporter{release: make(chan struct{})}
+	tracer := NewBatchTracer(exporter, BatchOptions{QueueSize: 2, BatchSize: 1})
+	finish := func() {
+		_, span := tracer.Start(t.Context(), "work", SpanKindInternal)
+		span.Finish()
+	}
+
+	// Test: finishing a span doesn't wait for the exporter
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			finish()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Finish blocked on the exporter")
+	}
+
+	// Test: spans beyond the queue are dropped, the rest go out on Shutdown
+	assert.GreaterOrEqual(t, tracer.Dropped(), uint64(7))
+	close(exporter.release)
+	require.NoError(t, tracer.Shutdown(t.Context()))
+	assert.Equal(t, 10, len(exporter.spans)+int(tracer.Dropped()))
+
+	// Test: spans finished after Shutdown are dropped without blocking
+	finish()
+	assert.Equal(t, 10, len(exporter.spans)+int(tracer.Dropped()))
+
+	// Test: partial batches go out after the interval
+	memory := &memoryExporter{}
+	tracer = NewBatchTracer(memory, BatchOptions{Interval: 10 * time.Millisecond})
+	defer tracer.Shutdown(t.Context())
+	_, span := tracer.Start(t.Context(), "work", SpanKindInternal)
+	span.Finish()
+	assert.Eventually(t, func() bool {
+		memory.mu.Lock()
+		defer memory.mu.Unlock()
+		return len(memory.spans) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestExporters(t *testing.T) {
+	tracer := NewTracer(nil)
+	_, span := tracer.Start(t.Context(), "work", SpanKindInternal)
+	span.SetAttribute("items", 3)
+	span.Error = "boom"
+	span.Finish()
+
+	// Test: stdout writes one JSON object per span
+	var out bytes.Buffer
+	require.NoError(t, NewStdoutExporter(&out).ExportSpans([]*Span{span}))
+	var js map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &js))
+	assert.Equal(t, span.Context().TraceID.String(), js["trace_id"])
+	assert.Equal(t, "work", js["name"])
+	assert.Equal(t, "boom", js["error"])
+
+	// Test: OTLP/HTTP posts JSON to the collector
+	var body []byte
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+	exporter := &OTLPExporter{Endpoint: collector.URL + "/v1/traces", ServiceName: "test"}
+	require.NoError(t, exporter.ExportSpans([]*Span{span}))
+	assert.Equal(t, "application/json", contentType)
+	var req otlpRequest
+	require.NoError(t, json.Unmarshal(body, &req))
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "test", *rs.Resource.Attributes[0].Value.StringValue)
+	got := rs.ScopeSpans[0].Spans[0]
+	assert.Equal(t, span.Context().SpanID.String(), got.SpanID)
+	assert.Equal(t, int(SpanKindInternal), got.Kind)
+	assert.Equal(t, otlpStatusError, got.Status.Code)
+	assert.Equal(t, "3", *got.Attributes[0].Value.IntValue)
+
+	// Test: a collector error is reported
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	err := (&OTLPExporter{Endpoint: failing.URL}).ExportSpans([]*Span{span})
+	assert.ErrorIs(t, err, ERROR_EXPORT_REJECTED)
+}
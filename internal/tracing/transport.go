@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+)
+
+// Inject writes the active span in ctx onto outgoing request headers so
+// the next service continues the trace.
+func Inject(ctx context.Context, h http.Header) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	h.Set(TRACEPARENT_HEADER, s.sc.Traceparent())
+	if s.sc.TraceState != "" {
+		h.Set(TRACESTATE_HEADER, s.sc.TraceState)
+	}
+}
+
+// Transport is an http.RoundTripper that wraps each outbound request in a
+// client span and propagates it, for handlers that proxy to other services.
+type Transport struct {
+	Tracer *Tracer
+	// Base defaults to http.DefaultTransport
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, span := t.Tracer.Start(r.Context(), r.Method, SpanKindClient)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.full", r.URL.String())
+
+	r = r.Clone(ctx)
+	Inject(ctx, r.Header)
+	res, err := base.RoundTrip(r)
+	if err != nil {
+		span.Error = err.Error()
+	} else {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= 400 {
+			span.Error = res.Status
+		}
+	}
+	span.Finish()
+	return res, err
+}
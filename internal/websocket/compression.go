@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"build-http-protocol/internal/headers"
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Without context takeover every message is compressed on its own, which
+// keeps both ends stateless at the cost of some ratio.
+const deflateExtension = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// acceptsDeflate reports whether one of the client's permessage-deflate
+// offers can be taken as deflateExtension answers it. compress/flate always
+// uses a 32KB window, so an offer asking for a smaller server window (or
+// with parameters we don't know) is declined.
+func acceptsDeflate(h *headers.Headers) bool {
+	value, _ := h.Get("sec-websocket-extensions")
+	for _, offer := range strings.Split(value, ",") {
+		params := strings.Split(offer, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+		if acceptableDeflateParams(params[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptableDeflateParams(params []string) bool {
+	seen := map[string]bool{}
+	for _, p := range params {
+		name, value, hasValue := strings.Cut(p, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return false
+			}
+		case "server_max_window_bits":
+			if value != "15" {
+				return false
+			}
+		case "client_max_window_bits":
+			// we decompress with a full window, whatever the client uses
+			if bits, err := strconv.Atoi(value); hasValue && (err != nil || bits < 8 || bits > 15) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RFC 7692 section 7.2.1: the sync flush marker is stripped on the wire
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+func decompress(data []byte, maxSize int) ([]byte, error) {
+	// put the marker back, plus an empty final block so the reader sees a
+	// clean end of stream instead of io.ErrUnexpectedEOF
+	stream := append(append(data, deflateTail...), 0x01, 0x00, 0x00, 0xff, 0xff)
+	fr := flate.NewReader(bytes.NewReader(stream))
+	defer fr.Close()
+	out, err := io.ReadAll(io.LimitReader(fr, int64(maxSize)+1))
+	if err != nil {
+		return nil, ERROR_PROTOCOL
+	}
+	if len(out) > maxSize {
+		return nil, ERROR_MESSAGE_TOO_BIG
+	}
+	return out, nil
+}
@@ -0,0 +1,435 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	OpContinuation MessageType = 0x0
+	TextMessage    MessageType = 0x1
+	BinaryMessage  MessageType = 0x2
+	CloseMessage   MessageType = 0x8
+	PingMessage    MessageType = 0x9
+	PongMessage    MessageType = 0xa
+)
+
+// close status codes from RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	CloseMessageTooBig    = 1009
+)
+
+const (
+	DEFAULT_MAX_MESSAGE_SIZE = 1 << 20
+	maxControlPayload        = 125
+	closeTimeout             = 5 * time.Second
+)
+
+var ERROR_PROTOCOL = fmt.Errorf("websocket protocol error")
+var ERROR_MESSAGE_TOO_BIG = fmt.Errorf("websocket message too big")
+var ERROR_INVALID_UTF8 = fmt.Errorf("websocket text message is not valid utf-8")
+var ERROR_CLOSED = fmt.Errorf("websocket connection closed")
+
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+type Conn struct {
+	Subprotocol    string
+	MaxMessageSize int
+	// PongHandler, if set, is called with the payload of each pong received.
+	PongHandler func(data []byte)
+
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+	compress bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+	// readMu is held by whoever is reading frames, ReadMessage or Close,
+	// and guards closeError
+	readMu     sync.Mutex
+	closeError *CloseError
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer, compress bool) *Conn {
+	return &Conn{
+		MaxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+		conn:           conn,
+		br:             br,
+		isServer:       isServer,
+		compress:       compress,
+	}
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  MessageType
+	payload []byte
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, head); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		rsv1:   head[0]&0x40 != 0,
+		opcode: MessageType(head[0] & 0x0f),
+	}
+	if head[0]&0x30 != 0 || (f.rsv1 && !c.compress) {
+		return nil, ERROR_PROTOCOL
+	}
+	masked := head[1]&0x80 != 0
+	// clients must mask every frame and servers must never mask
+	if masked != c.isServer {
+		return nil, ERROR_PROTOCOL
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if f.opcode >= CloseMessage {
+		if !f.fin || length > maxControlPayload || f.rsv1 {
+			return nil, ERROR_PROTOCOL
+		}
+	}
+	if length > uint64(c.MaxMessageSize) {
+		return nil, ERROR_MESSAGE_TOO_BIG
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+func (c *Conn) writeFrame(f *frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ERROR_CLOSED
+	}
+
+	b := make([]byte, 0, len(f.payload)+14)
+	first := byte(f.opcode)
+	if f.fin {
+		first |= 0x80
+	}
+	if f.rsv1 {
+		first |= 0x40
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	length := len(f.payload)
+	switch {
+	case length <= 125:
+		b = append(b, maskBit|byte(length))
+	case length <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+
+	payload := f.payload
+	if !c.isServer {
+		var key [4]byte
+		rand.Read(key[:])
+		b = append(b, key[:]...)
+		payload = append([]byte{}, f.payload...)
+		maskBytes(key, payload)
+	}
+	b = append(b, payload...)
+
+	if f.opcode == CloseMessage {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// ReadMessage returns the next complete data message, reassembling
+// fragments and answering pings and close frames along the way. Once the
+// peer closes, it returns a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.closeError != nil {
+		return 0, nil, c.closeError
+	}
+
+	var msgType MessageType
+	var compressed bool
+	message := []byte{}
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			c.failConnection(err)
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			c.writeFrame(&frame{fin: true, opcode: PongMessage, payload: f.payload})
+			continue
+		case PongMessage:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case TextMessage, BinaryMessage:
+			if msgType != 0 {
+				c.failConnection(ERROR_PROTOCOL)
+				return 0, nil, ERROR_PROTOCOL
+			}
+			msgType = f.opcode
+			compressed = f.rsv1
+		case OpContinuation:
+			if msgType == 0 || f.rsv1 {
+				c.failConnection(ERROR_PROTOCOL)
+				return 0, nil, ERROR_PROTOCOL
+			}
+		default:
+			c.failConnection(ERROR_PROTOCOL)
+			return 0, nil, ERROR_PROTOCOL
+		}
+
+		if len(message)+len(f.payload) > c.MaxMessageSize {
+			c.failConnection(ERROR_MESSAGE_TOO_BIG)
+			return 0, nil, ERROR_MESSAGE_TOO_BIG
+		}
+		message = append(message, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		message, err = decompress(message, c.MaxMessageSize)
+		if err != nil {
+			c.failConnection(err)
+			return 0, nil, err
+		}
+	}
+	if msgType == TextMessage && !utf8.Valid(message) {
+		c.failConnection(ERROR_INVALID_UTF8)
+		return 0, nil, ERROR_INVALID_UTF8
+	}
+	return msgType, message, nil
+}
+
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return ERROR_PROTOCOL
+	}
+	f := &frame{fin: true, opcode: msgType, payload: data}
+	if c.compress {
+		compressed, err := compress(data)
+		if err != nil {
+			return err
+		}
+		f.payload = compressed
+		f.rsv1 = true
+	}
+	return c.writeFrame(f)
+}
+
+// WriteFragmented sends data as a single message split into frames of at
+// most fragmentSize bytes.
+func (c *Conn) WriteFragmented(msgType MessageType, data []byte, fragmentSize int) error {
+	if msgType != TextMessage && msgType != BinaryMessage || fragmentSize <= 0 {
+		return ERROR_PROTOCOL
+	}
+	opcode := msgType
+	for {
+		n := min(fragmentSize, len(data))
+		fin := n == len(data)
+		if err := c.writeFrame(&frame{fin: fin, opcode: opcode, payload: data[:n]}); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[n:]
+		opcode = OpContinuation
+	}
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ERROR_PROTOCOL
+	}
+	return c.writeFrame(&frame{fin: true, opcode: PingMessage, payload: data})
+}
+
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatusReceived {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(b, reason...)
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func parseClose(payload []byte) *CloseError {
+	ce := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		ce.Code = CloseProtocolError
+	case len(payload) >= 2:
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) || !utf8.ValidString(ce.Reason) {
+			ce.Code = CloseProtocolError
+		}
+	}
+	return ce
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	ce := parseClose(payload)
+	c.closeError = ce
+
+	// echo the status back to complete the closing handshake
+	reply := ce.Code
+	if reply == CloseNoStatusReceived {
+		reply = CloseNormalClosure
+	}
+	c.writeFrame(&frame{fin: true, opcode: CloseMessage, payload: closePayload(reply, "")})
+	c.conn.Close()
+	return ce
+}
+
+func (c *Conn) failConnection(err error) {
+	code := CloseProtocolError
+	switch err {
+	case ERROR_MESSAGE_TOO_BIG:
+		code = CloseMessageTooBig
+	case ERROR_INVALID_UTF8:
+		code = CloseInvalidPayload
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(&frame{fin: true, opcode: CloseMessage, payload: closePayload(code, "")})
+	c.conn.Close()
+}
+
+// Close starts the closing handshake and waits briefly for the peer's close
+// frame before dropping the connection. When another goroutine is in
+// ReadMessage, that reader picks up the peer's close frame instead.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason)+2 > maxControlPayload {
+		// the reason must stay valid UTF-8, so don't split a rune
+		n := maxControlPayload - 2
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	err := c.writeFrame(&frame{fin: true, opcode: CloseMessage, payload: closePayload(code, reason)})
+	if err != nil {
+		return c.closeConn()
+	}
+
+	// the deadline also wakes up a reader blocked in ReadMessage, so the
+	// lock is free once it has seen the close frame or given up
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.closeError == nil {
+		f, err := c.readFrame()
+		if err != nil {
+			break
+		}
+		if f.opcode == CloseMessage {
+			// later reads report it like ReadMessage would have
+			c.closeError = parseClose(f.payload)
+			break
+		}
+	}
+	return c.closeConn()
+}
+
+// closeConn closes the underlying connection, which the reader may already
+// have done after the peer's close frame.
+func (c *Conn) closeConn() error {
+	if err := c.conn.Close(); !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
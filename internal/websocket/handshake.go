@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"bufio"
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+)
+
+// GUID from RFC 6455 section 1.3, appended to the client key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ERROR_BAD_HANDSHAKE = fmt.Errorf("bad websocket handshake")
+var ERROR_UNSUPPORTED_VERSION = fmt.Errorf("unsupported websocket version")
+
+type UpgradeOptions struct {
+	// Subprotocols the server speaks, most preferred first.
+	Subprotocols []string
+	// EnableCompression accepts permessage-deflate when the client offers it.
+	EnableCompression bool
+	MaxMessageSize    int
+}
+
+func computeAccept(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tokenList splits a comma separated header value into lowercase tokens,
+// dropping any ;parameters.
+func tokenList(h *headers.Headers, name string) []string {
+	value, _ := h.Get(name)
+	tokens := []string{}
+	for _, t := range strings.Split(value, ",") {
+		t, _, _ = strings.Cut(t, ";")
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func IsUpgrade(req *request.Request) bool {
+	return slices.Contains(tokenList(req.Headers, "connection"), "upgrade") &&
+		slices.Contains(tokenList(req.Headers, "upgrade"), "websocket")
+}
+
+func negotiateSubprotocol(req *request.Request, supported []string) string {
+	value, _ := req.Headers.Get("sec-websocket-protocol")
+	offered := []string{}
+	for _, p := range strings.Split(value, ",") {
+		offered = append(offered, strings.TrimSpace(p))
+	}
+	for _, p := range supported {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Upgrade completes the server side of the opening handshake and takes the
+// connection over from w. On error nothing has been written, so the handler
+// can still answer with a normal 400.
+func Upgrade(w *response.Writer, req *request.Request, opts UpgradeOptions) (*Conn, error) {
+	if req.RequestLine.Method != "GET" || !IsUpgrade(req) {
+		return nil, ERROR_BAD_HANDSHAKE
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); version != "13" {
+		return nil, ERROR_UNSUPPORTED_VERSION
+	}
+	key, _ := req.Headers.Get("sec-websocket-key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, ERROR_BAD_HANDSHAKE
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", computeAccept(key))
+	protocol := negotiateSubprotocol(req, opts.Subprotocols)
+	if protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	compress := opts.EnableCompression && acceptsDeflate(req.Headers)
+	if compress {
+		h.Set("Sec-WebSocket-Extensions", deflateExtension)
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// frames the client sent right behind the handshake are already buffered
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	c := newConn(conn, br, true, compress)
+	c.Subprotocol = protocol
+	if opts.MaxMessageSize > 0 {
+		c.MaxMessageSize = opts.MaxMessageSize
+	}
+	return c, nil
+}
+
+// ClientHandshake performs the client side of the opening handshake over an
+// already established conn, mostly useful for tests and tools.
+func ClientHandshake(conn net.Conn, host, target string, subprotocols []string, compress bool) (*Conn, error) {
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\n", target, host)
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", key)
+	if len(subprotocols) > 0 {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(subprotocols, ", "))
+	}
+	if compress {
+		fmt.Fprintf(&b, "Sec-WebSocket-Extensions: %s\r\n", deflateExtension)
+	}
+	b.WriteString("\r\n")
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(statusLine, "HTTP/1.1 101 ") {
+		return nil, ERROR_BAD_HANDSHAKE
+	}
+
+	raw := []byte{}
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, line...)
+		if bytes.Equal(line, headers.CRLF) {
+			break
+		}
+	}
+	h := headers.NewHeaders()
+	if _, _, err := h.Parse(raw); err != nil {
+		return nil, err
+	}
+
+	if accept, _ := h.Get("sec-websocket-accept"); accept != computeAccept(key) {
+		return nil, ERROR_BAD_HANDSHAKE
+	}
+	extensions, _ := h.Get("sec-websocket-extensions")
+	c := newConn(conn, br, false, strings.Contains(extensions, "permessage-deflate"))
+	c.Subprotocol, _ = h.Get("sec-websocket-protocol")
+	return c, nil
+}
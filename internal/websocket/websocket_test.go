@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"bufio"
+	"build-http-protocol/internal/headers"
+	"build-http-protocol/internal/request"
+	"build-http-protocol/internal/response"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer runs the server half of a net.Pipe: it parses the
+// handshake, upgrades and echoes every message until the peer closes.
+func startEchoServer(t *testing.T, opts UpgradeOptions) (net.Conn, <-chan error) {
+	serverConn, clientConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		reader := request.NewConnReader(serverConn, request.Options{})
+		req, err := reader.ReadRequest()
+		if err != nil {
+			done <- err
+			return
+		}
+		c, err := Upgrade(response.NewConnWriter(serverConn, reader.Buffered), req, opts)
+		if err != nil {
+			serverConn.Close()
+			done <- err
+			return
+		}
+		for {
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			c.WriteMessage(msgType, data)
+		}
+	}()
+	return clientConn, done
+}
+
+func TestEcho(t *testing.T) {
+	conn, done := startEchoServer(t, UpgradeOptions{Subprotocols: []string{"chat.v2", "chat.v1"}})
+	c, err := ClientHandshake(conn, "localhost", "/ws", []string{"chat.v1", "chat.v2"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "chat.v2", c.Subprotocol)
+
+	// Test: text and binary round trip
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	msgType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, msgType)
+	assert.Equal(t, "hello", string(data))
+
+	big := []byte(strings.Repeat("x", 70000))
+	require.NoError(t, c.WriteMessage(BinaryMessage, big))
+	msgType, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, msgType)
+	assert.Equal(t, big, data)
+
+	// Test: fragments are reassembled
+	require.NoError(t, c.WriteFragmented(TextMessage, []byte("fragmented message"), 4))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented message", string(data))
+
+	// Test: ping is answered with a pong carrying the same payload
+	pong := make(chan string, 1)
+	c.PongHandler = func(data []byte) { pong <- string(data) }
+	require.NoError(t, c.Ping([]byte("are you there")))
+	// net.Pipe is unbuffered, so the pong has to be read while we write
+	go c.WriteMessage(TextMessage, []byte("after ping"))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there", <-pong)
+
+	// Test: close handshake
+	require.NoError(t, c.Close(CloseNormalClosure, "bye"))
+	err = <-done
+	require.IsType(t, &CloseError{}, err)
+	assert.Equal(t, CloseNormalClosure, err.(*CloseError).Code)
+	assert.Equal(t, "bye", err.(*CloseError).Reason)
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	conn, done := startEchoServer(t, UpgradeOptions{})
+	c, err := ClientHandshake(conn, "localhost", "/ws", nil, false)
+	require.NoError(t, err)
+
+	// Test: the reading goroutine gets the peer's close frame and Close
+	// waits for it instead of reading alongside
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		read <- err
+	}()
+	require.NoError(t, c.Close(CloseGoingAway, "shutdown"))
+	err = <-read
+	require.IsType(t, &CloseError{}, err)
+	assert.Equal(t, CloseGoingAway, err.(*CloseError).Code)
+	assert.IsType(t, &CloseError{}, <-done)
+
+	// Test: a long reason is cut on a rune boundary so it stays valid UTF-8
+	conn, done = startEchoServer(t, UpgradeOptions{})
+	c, err = ClientHandshake(conn, "localhost", "/ws", nil, false)
+	require.NoError(t, err)
+	require.NoError(t, c.Close(CloseGoingAway, "xy"+strings.Repeat("é", 100)))
+	err = <-done
+	require.IsType(t, &CloseError{}, err)
+	assert.Equal(t, "xy"+strings.Repeat("é", 60), err.(*CloseError).Reason)
+}
+
+func TestCompression(t *testing.T) {
+	conn, _ := startEchoServer(t, UpgradeOptions{EnableCompression: true})
+	c, err := ClientHandshake(conn, "localhost", "/ws", nil, true)
+	require.NoError(t, err)
+	require.True(t, c.compress)
+
+	msg := strings.Repeat("compress me ", 100)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(msg)))
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(data))
+	c.Close(CloseNormalClosure, "")
+
+	// Test: offers asking for a smaller server window are declined
+	for offer, want := range map[string]bool{
+		"permessage-deflate":                                                true,
+		"permessage-deflate; client_max_window_bits":                        true,
+		"permessage-deflate; server_max_window_bits=15":                     true,
+		"permessage-deflate; server_max_window_bits=10":                     false,
+		"permessage-deflate; server_max_window_bits=10, permessage-deflate": true,
+		"permessage-deflate; client_max_window_bits=20":                     false,
+		"permessage-deflate; unknown_param":                                 false,
+		"x-webkit-deflate-frame":                                            false,
+	} {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Extensions", offer)
+		assert.Equal(t, want, acceptsDeflate(h), offer)
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		clientConn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	}()
+	req, err := request.RequestFromReader(serverConn)
+	require.NoError(t, err)
+	_, err = Upgrade(response.NewWriter(serverConn), req, UpgradeOptions{})
+	assert.Equal(t, ERROR_BAD_HANDSHAKE, err)
+
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", computeAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	conn, done := startEchoServer(t, UpgradeOptions{})
+	c, err := ClientHandshake(conn, "localhost", "/ws", nil, false)
+	require.NoError(t, err)
+
+	// a FIN text frame with the mask bit clear
+	go conn.Write([]byte{0x81, 0x04, 'o', 'o', 'p', 's'})
+	// the server answers with a close frame before dropping the connection
+	_, _, err = c.ReadMessage()
+	require.IsType(t, &CloseError{}, err)
+	assert.Equal(t, CloseProtocolError, err.(*CloseError).Code)
+	assert.Equal(t, ERROR_PROTOCOL, <-done)
+}
+
+func TestFrameBehindHandshake(t *testing.T) {
+	conn, _ := startEchoServer(t, UpgradeOptions{})
+	defer conn.Close()
+
+	// the first frame arrives in the same read as the handshake, so the
+	// server only sees it if Hijack passed the buffered bytes on
+	go conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n" +
+		"\x81\x82\x00\x00\x00\x00hi"))
+
+	br := bufio.NewReader(conn)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	c := newConn(conn, br, false, false)
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+}